@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLog records every command in Common Log Format, one line each:
+//
+//	127.0.0.1:5000 - - [01/May/2020:10:00:00 +0000] "KNN {1, 2}" 200 76
+//
+// that is the remote address, two unused fields, the time the command was
+// answered, the action followed by its point if it has one, the status code
+// of the response as with the status_codes option, and the number of bytes of
+// the response. Fields without a value, such as the action of a command that
+// cannot be parsed, are a dash.
+type AccessLog struct {
+	sync.Mutex
+	fname string
+	file  *os.File
+}
+
+// accessLog is the daemon-wide access log, opened from
+// ServerConfig.AccessLogFile; commands are not recorded when it is nil.
+var accessLog *AccessLog
+
+// OpenAccessLog opens fname for appending, creating it if needed.
+func OpenAccessLog(fname string) (*AccessLog, error) {
+	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLog{fname: fname, file: file}, nil
+}
+
+// Reopen closes the file of the log and opens its path again, so that a log
+// renamed by a rotation is followed by a new one.
+func (log *AccessLog) Reopen() error {
+	if log == nil {
+		return nil
+	}
+	file, err := os.OpenFile(log.fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	log.Lock()
+	defer log.Unlock()
+	log.file.Close()
+	log.file = file
+	return nil
+}
+
+// Record logs a command with the given action and point, answered with the
+// response written to response.
+func (log *AccessLog) Record(response *CountingConn, action string, point []float64) {
+	if log == nil {
+		return
+	}
+	request := strings.ToUpper(action)
+	if request == "" {
+		request = "-"
+	}
+	if len(point) > 0 {
+		request += " " + FormatPoint(point)
+	}
+	remote := "-"
+	if addr := response.RemoteAddr(); addr != nil && addr.String() != "" {
+		remote = addr.String()
+	}
+	line := fmt.Sprintf("%s - - [%s] %q %d %d\n", remote, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		request, response.Code(), response.bytes)
+	log.Lock()
+	defer log.Unlock()
+	if _, err := log.file.WriteString(line); err != nil {
+		logger.Error("cannot write access log", "file", log.fname, "error", err)
+	}
+}
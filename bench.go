@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// BenchK is the number of neighbours requested by every BENCH query.
+const BenchK = 10
+
+// BenchResult summarises the latency of the queries run by Bench.
+type BenchResult struct {
+	queries int
+	eps     float64
+	p50     time.Duration
+	p99     time.Duration
+}
+
+func (result BenchResult) String() string {
+	return fmt.Sprintf("queries=%d k=%d eps=%g p50=%dus p99=%dus", result.queries, BenchK, result.eps,
+		result.p50.Microseconds(), result.p99.Microseconds())
+}
+
+// Bench runs queries KNN queries under the named metric, with the error
+// bound eps, for points drawn uniformly from the bounding box of the stored
+// points and reports their latency percentiles. The points are drawn from
+// seed, so that runs over the same tree are comparable, e.g. with and without
+// eps. Every query takes the read lock on its own, like a client query would,
+// so the latencies include lock contention with concurrent writers. It
+// returns false when the store is empty, and the error of the first query
+// that fails, such as ErrKTooLarge when BenchK is over the MaxK, as the
+// latency of a rejected query is not that of a search.
+func Bench(store *KdtreeStore, queries int, seed int64, metric string, eps float64) (BenchResult, bool, error) {
+	lower, upper, ok := store.Bounds()
+	if !ok {
+		return BenchResult{}, false, nil
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	latencies := make([]time.Duration, queries)
+	query := make([]float64, len(lower))
+	for n := range latencies {
+		for i := range query {
+			query[i] = lower[i] + random.Float64()*(upper[i]-lower[i])
+		}
+		start := time.Now()
+		if _, err := store.ApproximateKNN(query, BenchK, metric, eps); err != nil {
+			return BenchResult{}, true, err
+		}
+		latencies[n] = time.Since(start)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return BenchResult{
+		queries: queries,
+		eps:     eps,
+		p50:     latencies[(queries-1)*50/100],
+		p99:     latencies[(queries-1)*99/100],
+	}, true, nil
+}
@@ -0,0 +1,168 @@
+// Command kdtree-cli runs a single command against a kdtreed server and
+// prints the response, e.g.
+//
+//	kdtree-cli add 1,2 42
+//	kdtree-cli del 1,2
+//	kdtree-cli knn 1,2 5
+//	kdtree-cli range 0,0 10,10
+//
+// Points are given as comma-separated coordinates. The server address is
+// read from the host and port of the daemon's config file, and can be
+// overridden with -host and -port.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/etude-ist/kdtreed/protocol"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usage lists the subcommands with the number of arguments they take.
+var usage = map[string]int{
+	"add":   2,
+	"del":   1,
+	"knn":   2,
+	"range": 2,
+}
+
+// StatusCode matches the status code prefixing responses when the server
+// has status_codes set.
+var StatusCode = regexp.MustCompile(`^[0-9]{3} `)
+
+// MakePoint parses comma-separated coordinates, e.g. 1,2.5.
+func MakePoint(arg string) ([]float64, error) {
+	fields := strings.Split(arg, ",")
+	point := make([]float64, len(fields))
+	for i, field := range fields {
+		x, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coordinate %q", field)
+		}
+		point[i] = x
+	}
+	return point, nil
+}
+
+// MakeCommand builds the protocol command for a subcommand and reports
+// whether its response is a list of lines ending with END.
+func MakeCommand(sub string, args []string) (string, bool, error) {
+	point, err := MakePoint(args[0])
+	if err != nil {
+		return "", false, err
+	}
+	switch sub {
+	case "add":
+		return fmt.Sprintf("ADD %s %s", protocol.FormatPoint(point), args[1]), false, nil
+	case "del":
+		return fmt.Sprintf("DEL %s", protocol.FormatPoint(point)), false, nil
+	case "knn":
+		return fmt.Sprintf("KNN %s %s", protocol.FormatPoint(point), args[1]), true, nil
+	default:
+		upper, err := MakePoint(args[1])
+		if err != nil {
+			return "", false, err
+		}
+		return fmt.Sprintf("RANGE %s %s", protocol.FormatPoint(point), protocol.FormatPoint(upper)), true, nil
+	}
+}
+
+func main() {
+	config := struct {
+		Host         string
+		Port         string
+		QuietConnect bool `toml:"quiet_connect"`
+		StatusCodes  bool `toml:"status_codes"`
+	}{Host: "localhost", Port: "8001"}
+	fname := flag.String("config", "config.toml", "config file of the server")
+	host := flag.String("host", "", "server host, overriding the config file")
+	port := flag.String("port", "", "server port, overriding the config file")
+	token := flag.String("token", "", "token to authenticate with")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kdtree-cli [flags] add <point> <data> | del <point> | knn <point> <k> | range <lower> <upper>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if _, err := toml.DecodeFile(*fname, &config); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "cannot read config:", err)
+		os.Exit(2)
+	}
+	if *host != "" {
+		config.Host = *host
+	}
+	if *port != "" {
+		config.Port = *port
+	}
+
+	args := flag.Args()
+	if len(args) == 0 || usage[args[0]] != len(args)-1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, list, err := MakeCommand(args[0], args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	connection, err := net.DialTimeout("tcp", net.JoinHostPort(config.Host, config.Port), 5*time.Second)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cannot connect:", err)
+		os.Exit(1)
+	}
+	defer connection.Close()
+	reader := bufio.NewReader(connection)
+	// Skip the banner.
+	if !config.QuietConnect {
+		if _, err := reader.ReadString('\n'); err != nil {
+			fmt.Fprintln(os.Stderr, "cannot read from server:", err)
+			os.Exit(1)
+		}
+	}
+	// readLine reads a response line without its ending and, when the
+	// server sends them, its status code.
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if config.StatusCodes {
+			line = StatusCode.ReplaceAllString(line, "")
+		}
+		return line, err
+	}
+	if *token != "" {
+		fmt.Fprintf(connection, "AUTH %s\r\n", *token)
+		if line, err := readLine(); err != nil || line != "OK" {
+			fmt.Fprintln(os.Stderr, "authentication failed")
+			os.Exit(1)
+		}
+	}
+
+	fmt.Fprintf(connection, "%s\r\n", command)
+	for {
+		line, err := readLine()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "cannot read from server:", err)
+			os.Exit(1)
+		}
+		// An empty list is answered with EMPTY rather than a bare END.
+		if line == "END" || list && line == "EMPTY" {
+			break
+		}
+		if protocol.IsError(line) {
+			fmt.Fprintln(os.Stderr, line)
+			os.Exit(1)
+		}
+		fmt.Println(line)
+		if !list {
+			break
+		}
+	}
+	fmt.Fprint(connection, "END\r\n")
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ServerConfig struct {
+	// Network is tcp (dual-stack), tcp4, tcp6 or unix, in which case Host
+	// is the path of the socket and Port is unused.
+	Network  string
+	Host     string
+	Port     string
+	DataFile string `toml:"data_file"`
+	// SnapshotDir is the directory the paths given to SAVE and LOAD are
+	// relative to; they may not leave it. SAVE and LOAD take no path when
+	// it is empty.
+	SnapshotDir string `toml:"snapshot_dir"`
+	// SnapshotInterval is the number of seconds between automatic saves
+	// to DataFile; 0 disables them.
+	SnapshotInterval int `toml:"snapshot_interval"`
+	// WalFile logs every mutation so that writes made after the last
+	// snapshot survive a crash.
+	WalFile string `toml:"wal_file"`
+	// ReadTimeout is the number of seconds a connection may stay idle
+	// before it is closed; 0 disables the timeout.
+	ReadTimeout int `toml:"read_timeout"`
+	// WriteTimeout is the number of seconds a write of streamed results
+	// may block on a client that does not read them before the connection
+	// is closed; 0 disables the timeout.
+	WriteTimeout int `toml:"write_timeout"`
+	// KeepAlive is the number of seconds between the TCP keep-alive probes
+	// of idle connections, which detect peers gone without closing them;
+	// 0 disables keep-alive. It defaults to 15, as Go does.
+	KeepAlive int `toml:"keep_alive"`
+	// NoDelay disables Nagle's algorithm on connections, so that every
+	// response is sent as soon as it is written rather than held back to
+	// be coalesced with the next. It is set by default, as Go does; unset
+	// it to trade latency for fewer packets.
+	NoDelay bool `toml:"no_delay"`
+	// MaxConnections bounds the number of connections served at once; 0
+	// means no limit. Once it is reached new connections are refused with
+	// TOO MANY CONNECTIONS, or left waiting when QueueConnections is set.
+	MaxConnections   int  `toml:"max_connections"`
+	QueueConnections bool `toml:"queue_connections"`
+	// MetricsAddr is the address of the HTTP server exposing Prometheus
+	// metrics at /metrics; it is not started when empty.
+	MetricsAddr string `toml:"metrics_addr"`
+	// LogLevel is the least severe level logged: debug, info, warn or
+	// error.
+	LogLevel string `toml:"log_level"`
+	// RestAddr is the address of the HTTP server exposing the REST API; it
+	// is not started when empty.
+	RestAddr string `toml:"rest_addr"`
+	// PprofAddr is the address of the HTTP server exposing the profiles of
+	// net/http/pprof at /debug/pprof/; it is not started when empty. The
+	// profiles reveal the internals of the daemon, so it should only be
+	// bound to a private address.
+	PprofAddr string `toml:"pprof_addr"`
+	// TLSCertFile and TLSKeyFile are the PEM certificate and key the TCP
+	// listener uses when both are set; otherwise it speaks plaintext.
+	TLSCertFile string `toml:"tls_cert_file"`
+	TLSKeyFile  string `toml:"tls_key_file"`
+	// AuthToken, when set, must be presented with AUTH before any command
+	// other than AUTH, PING, MODE and END is accepted, and as a bearer
+	// token on REST requests.
+	AuthToken string `toml:"auth_token"`
+	// BenchSeed seeds the random queries run by BENCH, so that runs are
+	// reproducible.
+	BenchSeed int `toml:"bench_seed"`
+	// BenchMax bounds the number of queries BENCH may run, as larger runs
+	// are answered with TOO LARGE; 0 means no bound.
+	BenchMax int `toml:"bench_max"`
+	// MknnMax bounds the number of query points of an MKNN, which are all
+	// kept in memory and answered under a single read lock; 0 means no
+	// bound.
+	MknnMax int `toml:"mknn_max"`
+	// MaxImportBytes bounds the size of the document of an IMPORT, which
+	// is kept in memory until END; 0 means no bound.
+	MaxImportBytes int `toml:"max_import_bytes"`
+	// Epsilon is the tolerance within which DEL and UPDATE treat stored
+	// coordinates as equal to the given ones; 0 requires exact equality.
+	Epsilon float64
+	// DistanceMetric is the metric KNN, NEAREST and BALL rank points by
+	// unless a connection selects another one with METRIC: euclidean,
+	// manhattan or chebyshev.
+	DistanceMetric string `toml:"distance_metric"`
+	// MaxLineLength bounds the length in bytes of a command line; longer
+	// lines are discarded and answered with LINE TOO LONG. 0 means no
+	// limit.
+	MaxLineLength int `toml:"max_line_length"`
+	// MaxDimensions bounds the coordinates of a point and MaxPayloadBytes
+	// the length of a payload as sent, e.g. a quoted string with its
+	// quotes; larger ones are answered with TOO LARGE. 0 means no limit.
+	MaxDimensions   int `toml:"max_dimensions"`
+	MaxPayloadBytes int `toml:"max_payload_bytes"`
+	// ReadOnly rejects the commands that modify the store with READ ONLY,
+	// for replicas serving queries over a snapshot of a primary.
+	ReadOnly bool `toml:"read_only"`
+	// RateLimit bounds the commands per second of every client IP; 0 means
+	// no limit. Commands over the limit are answered with RATE LIMITED, or
+	// delayed until they are within it when RateLimitDelay is set.
+	RateLimit      int  `toml:"rate_limit"`
+	RateLimitDelay bool `toml:"rate_limit_delay"`
+	// InitialCapacity is the number of points room is made for when the
+	// data file is loaded and when the tree is rebuilt, for datasets of
+	// known size; 0 grows the point slices as needed.
+	InitialCapacity int `toml:"initial_capacity"`
+	// QueryTimeout is the number of milliseconds the traversals of a query
+	// may run for, under the read lock, before the query is aborted with
+	// QUERY TIMEOUT; 0 disables the timeout.
+	QueryTimeout int `toml:"query_timeout"`
+	// SlowQueryThreshold is the number of milliseconds past which a
+	// command is logged at warn level, with the time it took and the size
+	// of its response; 0 logs none.
+	SlowQueryThreshold int `toml:"slow_query_threshold"`
+	// AccessLogFile, when set, records every command in Common Log Format,
+	// as described at AccessLog, apart from the diagnostic log. It is
+	// reopened on SIGHUP, so that it can be rotated by renaming it.
+	AccessLogFile string `toml:"access_log_file"`
+	// CoordinateScale, when set, stores coordinates as integers in units of
+	// 1/CoordinateScale, e.g. 1e6 for millionths of a degree of latitude or
+	// longitude: incoming coordinates are multiplied by it and rounded to
+	// the nearest integer, and divided by it again in responses, so that
+	// DEL and UPDATE match stored points exactly. Rounding is done on the
+	// float64 product, halfway away from zero; a coordinate halfway between
+	// two steps in decimal, such as 0.0000005 at 1e6, may be just below or
+	// above halfway in binary, and so rounds either way, though always the
+	// same way. Scaled coordinates beyond 2^53 are no longer integers. 0
+	// stores coordinates as sent.
+	CoordinateScale float64 `toml:"coordinate_scale"`
+	// MaxK bounds the number of neighbours a KNN query may ask for, as
+	// larger queries are answered with K TOO LARGE; 0 means no bound.
+	MaxK int `toml:"max_k"`
+	// SeedFile is a CSV file of `x,y,...,data` rows loaded on startup when
+	// there is no saved data to load from DataFile.
+	SeedFile string `toml:"seed_file"`
+	// LineEnding terminates response lines with CRLF when crlf, or with a
+	// bare LF when lf.
+	LineEnding string `toml:"line_ending"`
+	// DuplicatePolicy decides what ADD does with a point matching a stored
+	// one: allow stores both, replace updates the stored payload, and
+	// reject fails with DUPLICATE.
+	DuplicatePolicy string `toml:"duplicate_policy"`
+	// DedupWindow is the number of milliseconds within which an ADD of the
+	// exact coordinates of the last ADD of them is dropped and answered
+	// with DEDUPED, whatever its payload; 0 drops none.
+	DedupWindow int `toml:"dedup_window"`
+	// Banner is the line every connection is greeted with, unless
+	// QuietConnect is set, in which case the first line a client reads is
+	// the response to its first command.
+	Banner       string `toml:"banner"`
+	QuietConnect bool   `toml:"quiet_connect"`
+	// StatusCodes prefixes every line of the text protocol with a status
+	// code after HTTP's, e.g. `200 {1, 2} added` or `404 NOT FOUND`; see
+	// protocol.StatusCodes.
+	StatusCodes bool `toml:"status_codes"`
+	// ScoreKernel and ScoreBandwidth select how KNN ... SCORE turns
+	// distances into scores; see ScoreKernels.
+	ScoreKernel    string  `toml:"score_kernel"`
+	ScoreBandwidth float64 `toml:"score_bandwidth"`
+}
+
+// ReadConfig returns the config built by LoadConfig from fname, exiting if it
+// cannot be read.
+func ReadConfig(fname *string) ServerConfig {
+	config, err := LoadConfig(*fname)
+	if err != nil {
+		logger.Fatal("cannot read config", "file", *fname, "error", err)
+	}
+	return config
+}
+
+// DefaultConfig returns the built-in defaults LoadConfig starts from.
+func DefaultConfig() ServerConfig {
+	return ServerConfig{Network: "tcp", LogLevel: "info", DistanceMetric: "euclidean", MaxLineLength: 65536, MaxDimensions: 1024, MaxPayloadBytes: 16384, MaxK: 10000, LineEnding: "crlf", DuplicatePolicy: "allow",
+		WriteTimeout: 30, KeepAlive: 15, NoDelay: true, BenchMax: 100000, MknnMax: 10000, MaxImportBytes: 16 << 20, Banner: "Connected to kdtreed...", ScoreKernel: "inverse", ScoreBandwidth: 1}
+}
+
+// LoadConfig builds the config in three layers, each overriding the one
+// before: built-in defaults, the TOML read by DecodeConfig from fname, then
+// KDTREED_* environment variables (see ApplyEnv). A missing file is not an
+// error, so the config can come from the environment alone; Validate reports
+// anything left missing.
+func LoadConfig(fname string) (ServerConfig, error) {
+	config := DefaultConfig()
+	if err := DecodeConfig(fname, &config); os.IsNotExist(err) {
+		logger.Info("config file not found, using defaults and environment", "file", fname)
+	} else if err != nil {
+		return config, err
+	}
+	overridden, err := ApplyEnv(&config, os.LookupEnv)
+	if err != nil {
+		return config, fmt.Errorf("environment: %w", err)
+	}
+	if len(overridden) > 0 {
+		logger.Info("config overridden from environment", "variables", strings.Join(overridden, ","))
+	}
+	return config, nil
+}
+
+// DecodeConfig decodes the TOML config named by fname into config: standard
+// input when fname is -, the body of a GET when it is an http:// or https://
+// URL, and the file of that name otherwise.
+func DecodeConfig(fname string, config *ServerConfig) error {
+	if fname == "-" {
+		_, err := toml.DecodeReader(os.Stdin, config)
+		return err
+	}
+	if !strings.HasPrefix(fname, "http://") && !strings.HasPrefix(fname, "https://") {
+		_, err := toml.DecodeFile(fname, config)
+		return err
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(fname)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", fname, response.Status)
+	}
+	_, err = toml.DecodeReader(response.Body, config)
+	return err
+}
+
+// EnvName returns the environment variable overriding a config field: the
+// field's TOML key in upper case, prefixed with KDTREED_, e.g. KDTREED_PORT
+// or KDTREED_DATA_FILE.
+func EnvName(field reflect.StructField) string {
+	return "KDTREED_" + strings.ToUpper(ConfigKey(field))
+}
+
+// ConfigKey returns the TOML key of a config field, which is its name in
+// lower case for the fields without a toml tag.
+func ConfigKey(field reflect.StructField) string {
+	if key := field.Tag.Get("toml"); key != "" {
+		return key
+	}
+	return strings.ToLower(field.Name)
+}
+
+// ApplyEnv overrides the fields of config that have an environment variable
+// set, as looked up by lookup, and returns the names of those variables.
+func ApplyEnv(config *ServerConfig, lookup func(string) (string, bool)) ([]string, error) {
+	overridden := []string{}
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := EnvName(value.Type().Field(i))
+		env, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(env)
+		case reflect.Int:
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not an integer", name, env)
+			}
+			field.SetInt(int64(n))
+		case reflect.Float64:
+			x, err := strconv.ParseFloat(env, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not a number", name, env)
+			}
+			field.SetFloat(x)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(env)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not a boolean", name, env)
+			}
+			field.SetBool(b)
+		default:
+			return nil, fmt.Errorf("%s: unsupported config type %s", name, field.Kind())
+		}
+		overridden = append(overridden, name)
+	}
+	return overridden, nil
+}
+
+// Listen opens the listener for the TCP protocol, over TLS when a
+// certificate is configured. On the unix network the host is the path of the
+// socket. A socket left behind by a daemon that did not shut down cleanly is
+// removed first; the listener removes its own socket when it is closed.
+func Listen(config *ServerConfig) (net.Listener, error) {
+	address := config.Host
+	if config.Network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, fmt.Errorf("cannot remove stale socket: %w", err)
+			}
+		}
+	} else {
+		// Resolve the address first for a clear error on a bad host or
+		// port.
+		address = net.JoinHostPort(config.Host, config.Port)
+		if _, err := net.ResolveTCPAddr(config.Network, address); err != nil {
+			return nil, err
+		}
+	}
+	var cert tls.Certificate
+	tlsEnabled := config.TLSCertFile != "" && config.TLSKeyFile != ""
+	if tlsEnabled {
+		var err error
+		if cert, err = tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			return nil, fmt.Errorf("cannot load TLS certificate: %w", err)
+		}
+	}
+	listener, err := net.Listen(config.Network, address)
+	if err != nil {
+		return nil, err
+	}
+	if config.Network != "unix" {
+		listener = &TCPListener{Listener: listener, keepAlive: time.Duration(config.KeepAlive) * time.Second, noDelay: config.NoDelay}
+	}
+	if tlsEnabled {
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	return listener, nil
+}
+
+// TCPListener sets the keep-alive and no-delay options of the config on the
+// connections it accepts, before any TLS handshake.
+type TCPListener struct {
+	net.Listener
+	// keepAlive is the period of keep-alive probes, 0 disabling them.
+	keepAlive time.Duration
+	noDelay   bool
+}
+
+func (listener *TCPListener) Accept() (net.Conn, error) {
+	connection, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := connection.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(listener.keepAlive > 0)
+		if listener.keepAlive > 0 {
+			tcp.SetKeepAlivePeriod(listener.keepAlive)
+		}
+		tcp.SetNoDelay(listener.noDelay)
+	}
+	return connection, nil
+}
+
+// Hostname matches a DNS host name such as "localhost" or "kd.example.com".
+var Hostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*\.?$`)
+
+// Validate checks the config for values the daemon cannot work with, so that
+// they are reported on startup rather than as an obscure failure later on.
+func (config *ServerConfig) Validate() error {
+	switch config.Network {
+	case "tcp", "tcp4", "tcp6":
+		if config.Host != "" && net.ParseIP(config.Host) == nil && !Hostname.MatchString(config.Host) {
+			return fmt.Errorf("host: %q is neither an IP address nor a host name", config.Host)
+		}
+		if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("port: %q is not a port number between 1 and 65535", config.Port)
+		}
+	case "unix":
+		if config.Host == "" {
+			return fmt.Errorf("host: the unix network needs the path of the socket")
+		}
+	default:
+		return fmt.Errorf("network: unsupported network %q, expected tcp, tcp4, tcp6 or unix", config.Network)
+	}
+	for name, value := range map[string]int{
+		"snapshot_interval":    config.SnapshotInterval,
+		"read_timeout":         config.ReadTimeout,
+		"write_timeout":        config.WriteTimeout,
+		"keep_alive":           config.KeepAlive,
+		"max_connections":      config.MaxConnections,
+		"max_line_length":      config.MaxLineLength,
+		"max_dimensions":       config.MaxDimensions,
+		"max_payload_bytes":    config.MaxPayloadBytes,
+		"rate_limit":           config.RateLimit,
+		"initial_capacity":     config.InitialCapacity,
+		"max_k":                config.MaxK,
+		"bench_max":            config.BenchMax,
+		"mknn_max":             config.MknnMax,
+		"max_import_bytes":     config.MaxImportBytes,
+		"query_timeout":        config.QueryTimeout,
+		"dedup_window":         config.DedupWindow,
+		"slow_query_threshold": config.SlowQueryThreshold,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s: must not be negative, got %d", name, value)
+		}
+	}
+	if config.CoordinateScale < 0 || math.IsNaN(config.CoordinateScale) || math.IsInf(config.CoordinateScale, 0) {
+		return fmt.Errorf("coordinate_scale: must be a non-negative number, got %v", config.CoordinateScale)
+	}
+	if config.Epsilon < 0 || math.IsNaN(config.Epsilon) {
+		return fmt.Errorf("epsilon: must not be negative, got %v", config.Epsilon)
+	}
+	if config.SnapshotInterval > 0 && config.DataFile == "" {
+		return fmt.Errorf("snapshot_interval: snapshots need a data_file")
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file, tls_key_file: both or neither must be set")
+	}
+	if DistanceMetrics[config.Metric()] == nil {
+		return fmt.Errorf("distance_metric: unknown metric %q, expected euclidean, manhattan or chebyshev", config.DistanceMetric)
+	}
+	if config.LineEnding != "crlf" && config.LineEnding != "lf" {
+		return fmt.Errorf("line_ending: %q is neither crlf nor lf", config.LineEnding)
+	}
+	if strings.ContainsAny(config.Banner, "\r\n") {
+		return fmt.Errorf("banner: must be a single line")
+	}
+	if ScoreKernels[config.ScoreKernel] == nil {
+		return fmt.Errorf("score_kernel: unknown kernel %q", config.ScoreKernel)
+	}
+	if !(config.ScoreBandwidth > 0) || math.IsInf(config.ScoreBandwidth, 1) {
+		return fmt.Errorf("score_bandwidth: %v is not a positive number", config.ScoreBandwidth)
+	}
+	switch config.DuplicatePolicy {
+	case "allow", "replace", "reject":
+	default:
+		return fmt.Errorf("duplicate_policy: %q is not one of allow, replace or reject", config.DuplicatePolicy)
+	}
+	if _, err := ParseLogLevel(config.LogLevel); err != nil {
+		return fmt.Errorf("log_level: %v", err)
+	}
+	return nil
+}
+
+// Metric returns the name of the configured distance metric, in upper case
+// like the METRIC command takes it.
+func (config *ServerConfig) Metric() string {
+	return strings.ToUpper(config.DistanceMetric)
+}
+
+// Score returns the similarity score of a KNN result at the given distance
+// under the configured kernel.
+func (config *ServerConfig) Score(distance float64) float64 {
+	return ScoreKernels[config.ScoreKernel](distance, config.ScoreBandwidth)
+}
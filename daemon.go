@@ -2,26 +2,116 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/BurntSushi/toml"
+	"github.com/etude-ist/kdtreed/protocol"
 	"github.com/kyroy/kdtree"
 	"github.com/kyroy/kdtree/points"
-	"log"
+	"io"
+	"math"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// Magnitude matches an unsigned decimal, optionally in scientific notation,
+// e.g. 3, 1.5, .25 or 1e3.
+const Magnitude = `([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][-+]?[0-9]+)?`
+
+// Coordinate matches a single signed decimal coordinate.
+const Coordinate = `-?` + Magnitude
+
+// Point matches a brace-delimited, comma-separated list of coordinates.
+const Point = `{\s*` + Coordinate + `(\s*,\s*` + Coordinate + `)*\s*}`
+
+// Data is the payload attached to a point: an integer or, when quoted is
+// set, a string or, when vector is not nil, a list of numbers. It also
+// carries the time the point was added, which is zero for points loaded from
+// records without one.
 type Data struct {
+	value  int
+	str    string
+	quoted bool
+	vector []float64
+	added  time.Time
+}
+
+// Vector matches a bracketed, comma-separated list of numbers.
+const Vector = `\[\s*(` + Coordinate + `(\s*,\s*` + Coordinate + `)*)?\s*\]`
+
+// Filter is a predicate on integer payloads, such as the `data>10` of a
+// KNN WHERE clause, and on the time points were added, after since unless it
+// is zero. The zero Filter matches every payload.
+type Filter struct {
+	op    string
 	value int
+	since time.Time
+}
+
+// Matches reports whether data satisfies the filter. String and vector
+// payloads only match a Filter without an op.
+func (filter Filter) Matches(data Data) bool {
+	if !filter.since.IsZero() && data.added.Before(filter.since) {
+		return false
+	}
+	if filter.op == "" {
+		return true
+	}
+	if data.quoted || data.vector != nil {
+		return false
+	}
+	switch filter.op {
+	case ">":
+		return data.value > filter.value
+	case "<":
+		return data.value < filter.value
+	}
+	return data.value == filter.value
+}
+
+// startTime is when the daemon was started, for reporting its uptime.
+var startTime time.Time
+
+// Version and Commit identify the build. They are meant to be set when
+// building, e.g.
+//
+//	go build -ldflags "-X main.Version=1.4.0 -X main.Commit=$(git rev-parse --short HEAD)"
+var (
+	Version = "dev"
+	Commit  = "dev"
+)
+
+// MaxDimensions bounds the coordinates of the points and MaxPayloadBytes the
+// length of the payloads the parsers accept, as set from the config; larger
+// ones are rejected with TOO LARGE. 0 means no bound.
+var (
+	MaxDimensions   int
+	MaxPayloadBytes int
+)
+
+// TooLarge reports whether n is over limit, 0 meaning no limit.
+func TooLarge(n, limit int) bool {
+	return limit > 0 && n > limit
 }
 
-type ServerConfig struct {
-	Host string
-	Port string
+// VersionString returns the answer to VERSION, `kdtreed <version> <commit>`.
+func VersionString() string {
+	return fmt.Sprintf("kdtreed %s %s", Version, Commit)
 }
 
 type Expr struct {
@@ -29,13 +119,130 @@ type Expr struct {
 	position int
 	action   string
 	point    []float64
+	bound    []float64
+	radius   float64
+	k        int
+	eps      float64
+	mode     string
+	metric   string
+	filter   Filter
+	offset   int
+	limit    int
+	score    bool
+	axis     int
+	sorted   bool
+	path     string
+	token    string
+	name     string
+	format   string
 	data     Data
 	valid    bool
+	// comment is set for comments and blank lines, which are valid but do
+	// nothing.
+	comment bool
+	// failure is set by the sub-parser that failed last, and err to the
+	// failure of the grammar selected by the action, if any.
+	failure string
+	err     string
+	// stop is the position at which the last failing parser gave up.
+	stop int
+}
+
+// Session is the per-connection protocol state.
+type Session struct {
+	// authenticated is set once the client has presented the configured
+	// AuthToken, or from the start when there is none.
+	authenticated bool
+	// In JSON mode, selected with MODE JSON, every line is a JSONRequest
+	// and is answered with a JSONResponse.
+	jsonMode bool
+	// metric is the name of the distance metric selected with METRIC, or
+	// the configured one.
+	metric string
+	// inBatch is set between BEGIN and COMMIT or ABORT, while the
+	// mutations sent are queued in batch.
+	inBatch bool
+	batch   []Expr
+	// namespace is the name of the namespace selected with USE.
+	namespace string
+}
+
+// SnapshotFile returns the file SAVE and LOAD use given the path of the
+// command, empty when there is none, and whether it is the data file, so
+// that saving to it checkpoints the write-ahead log. Only the default
+// namespace is kept in the data file; the others need a path, which is
+// resolved by SnapshotPath.
+func (session *Session) SnapshotFile(config *ServerConfig, path string) (string, bool, error) {
+	if path != "" {
+		fname, err := SnapshotPath(config, path)
+		return fname, session.namespace == DefaultNamespace && fname == filepath.Clean(config.DataFile), err
+	}
+	if session.namespace != DefaultNamespace {
+		return "", false, nil
+	}
+	return config.DataFile, config.DataFile != "", nil
+}
+
+// Authenticate checks token against the configured AuthToken and records
+// the result in the session.
+func (session *Session) Authenticate(config *ServerConfig, token string) bool {
+	session.authenticated = config.AuthToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AuthToken)) == 1
+	return session.authenticated
+}
+
+// Allows reports whether the session may run a command with the given
+// action, which must be upper case.
+func (session *Session) Allows(action string) bool {
+	switch action {
+	case "AUTH", "PING", "MODE", "HELP", "END":
+		return true
+	}
+	return session.authenticated
 }
 
-type KdtreeStore struct {
+// Mutations are the actions that modify the store, which a read-only server
+// rejects.
+var Mutations = map[string]bool{"ADD": true, "UPDATE": true, "DEL": true, "CLEAR": true, "BULK": true, "LOAD": true, "DELRANGE": true, "IMPORT": true, "SWAP": true}
+
+// Connections tracks the open client connections so that they can be told
+// about and waited for on shutdown.
+type Connections struct {
 	sync.Mutex
-	tree *kdtree.KDTree
+	active  map[net.Conn]bool
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// String renders the payload the way it is written in an ADD command.
+func (data Data) String() string {
+	if data.quoted {
+		return strconv.Quote(data.str)
+	}
+	if data.vector != nil {
+		values := make([]string, len(data.vector))
+		for i, x := range data.vector {
+			values[i] = strconv.FormatFloat(x, 'g', -1, 64)
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	}
+	return strconv.Itoa(data.value)
+}
+
+// Fail records why a sub-parser failed and rewinds the expression.
+func (expr *Expr) Fail(failure string) bool {
+	expr.failure = failure
+	expr.stop = expr.position
+	expr.position = 0
+	return false
+}
+
+// Settle reports the result of matching the grammar of the command's own
+// action, keeping the sub-parser failure that made it fail.
+func (expr *Expr) Settle(rst bool) bool {
+	if !rst {
+		expr.err = expr.failure
+	}
+	return rst
 }
 
 func (expr *Expr) Current() string {
@@ -43,90 +250,468 @@ func (expr *Expr) Current() string {
 }
 
 func (expr *Expr) SkipWhitespace() {
-	for x := range expr.buffer[expr.position:] {
-		if string(x) != " " {
+	for _, x := range expr.buffer[expr.position:] {
+		if x != ' ' {
 			break
 		}
 		expr.position += 1
 	}
 }
 
-func ReadConfig(fname *string) ServerConfig {
-	var config ServerConfig
-	if _, err := toml.DecodeFile(*fname, &config); err != nil {
-		log.Fatal(err)
-	}
-	return config
-}
+// patterns caches the compiled tokens of Match, which are a fixed set of
+// constants, so that each is compiled once rather than on every match. They
+// are anchored, as only a match at the current position counts, so that a
+// failed match gives up there instead of searching the rest of the line.
+var patterns sync.Map
 
 func Match(expr *Expr, token string) (string, bool) {
 	expr.SkipWhitespace()
-	re, err := regexp.Compile(token)
-	if err != nil {
-		return "", false
+	cached, ok := patterns.Load(token)
+	if !ok {
+		compiled, err := regexp.Compile(`^(?:` + token + `)`)
+		if err != nil {
+			return "", false
+		}
+		cached, _ = patterns.LoadOrStore(token, compiled)
 	}
-	m := re.Find([]byte(expr.Current()))
-	if m != nil {
+	re := cached.(*regexp.Regexp)
+	loc := re.FindStringIndex(expr.Current())
+	if loc != nil && loc[0] == 0 {
+		m := expr.Current()[:loc[1]]
 		expr.position += len(m)
-		return string(m), true
+		return m, true
 	}
-	return string(m), false
+	return "", false
 }
 
 func IsAction(expr *Expr) bool {
-	if token, status := Match(expr, "ADD|DEL|KNN|END"); status {
-		expr.action = token
+	if token, status := Match(expr, ActionPattern); status {
+		// Actions are case-insensitive; the rest of the daemon only
+		// ever sees them in upper case.
+		expr.action = strings.ToUpper(token)
 		return true
 	}
+	expr.stop = expr.position
 	expr.position = 0
 	return false
 }
 
-func IsEndAction(expr *Expr) bool {
+// Near returns the start of the input left where parsing gave up, to point
+// the client at the offending part of an invalid command.
+func (expr *Expr) Near() string {
+	near := expr.buffer[expr.stop:]
+	if len(near) > 20 {
+		near = near[:20] + "..."
+	}
+	return near
+}
+
+// IsBareAction matches a command that consists of the given action alone.
+func IsBareAction(expr *Expr, action string) bool {
 	rst := IsAction(expr)
-	if expr.action == "END" {
+	if expr.action == action {
 		return rst
 	}
 	expr.position = 0
 	return false
 }
 
+func IsEndAction(expr *Expr) bool {
+	return IsBareAction(expr, "END")
+}
+
+func IsCountAction(expr *Expr) bool {
+	return IsBareAction(expr, "COUNT")
+}
+
+func IsClearAction(expr *Expr) bool {
+	return IsBareAction(expr, "CLEAR")
+}
+
+func IsPingAction(expr *Expr) bool {
+	return IsBareAction(expr, "PING")
+}
+
+func IsStatsAction(expr *Expr) bool {
+	return IsBareAction(expr, "STATS")
+}
+
+func IsDumpAction(expr *Expr) bool {
+	return IsBareAction(expr, "DUMP")
+}
+
+func IsBeginAction(expr *Expr) bool {
+	return IsBareAction(expr, "BEGIN")
+}
+
+func IsCommitAction(expr *Expr) bool {
+	return IsBareAction(expr, "COMMIT")
+}
+
+func IsAbortAction(expr *Expr) bool {
+	return IsBareAction(expr, "ABORT")
+}
+
+func IsDepthAction(expr *Expr) bool {
+	return IsBareAction(expr, "DEPTH")
+}
+
+func IsVersionAction(expr *Expr) bool {
+	return IsBareAction(expr, "VERSION")
+}
+
+func IsHelpAction(expr *Expr) bool {
+	return IsBareAction(expr, "HELP")
+}
+
+func IsBoundsAction(expr *Expr) bool {
+	return IsBareAction(expr, "BOUNDS")
+}
+
+func IsDrainAction(expr *Expr) bool {
+	return IsBareAction(expr, "DRAIN")
+}
+
+func IsRebalanceAction(expr *Expr) bool {
+	return IsBareAction(expr, "REBALANCE")
+}
+
 func IsPoint(expr *Expr) bool {
-	if token, status := Match(expr, "{[0-9]+, [0-9]+}"); status {
-		expr.point = MakePoint(token)
-		return true
+	if token, status := Match(expr, Point); status {
+		if point, err := MakePoint(token); err == nil {
+			if TooLarge(len(point), MaxDimensions) {
+				return expr.Fail("TOO LARGE")
+			}
+			expr.point = Scale(point)
+			return true
+		}
 	}
-	expr.position = 0
-	return false
+	return expr.Fail("INVALID POINT")
+}
+
+// IsBound matches a second point, such as the upper corner of a range.
+func IsBound(expr *Expr) bool {
+	if token, status := Match(expr, Point); status {
+		if bound, err := MakePoint(token); err == nil {
+			if TooLarge(len(bound), MaxDimensions) {
+				return expr.Fail("TOO LARGE")
+			}
+			expr.bound = Scale(bound)
+			return true
+		}
+	}
+	return expr.Fail("INVALID POINT")
 }
 
 func IsData(expr *Expr) bool {
+	if token, status := Match(expr, `"(\\.|[^"\\])*"`); status {
+		if TooLarge(len(token), MaxPayloadBytes) {
+			return expr.Fail("TOO LARGE")
+		}
+		if str, err := strconv.Unquote(token); err == nil {
+			expr.data = Data{str: str, quoted: true}
+			return true
+		}
+		return expr.Fail("INVALID DATA")
+	}
+	if token, status := Match(expr, Vector); status {
+		if TooLarge(len(token), MaxPayloadBytes) {
+			return expr.Fail("TOO LARGE")
+		}
+		if vector, err := MakePoint(token); err == nil {
+			expr.data = Data{vector: vector}
+			return true
+		}
+		return expr.Fail("INVALID DATA")
+	}
+	if token, status := Match(expr, "[0-9]+"); status {
+		if value, err := strconv.Atoi(token); err == nil {
+			expr.data = Data{value: value}
+			return true
+		}
+	}
+	return expr.Fail("INVALID DATA")
+}
+
+// IsRadius matches a non-negative distance.
+func IsRadius(expr *Expr) bool {
+	if token, status := Match(expr, Magnitude); status {
+		if radius, err := strconv.ParseFloat(token, 64); err == nil {
+			expr.radius = ScaleDistance(radius)
+			return true
+		}
+	}
+	return expr.Fail("INVALID RADIUS")
+}
+
+// IsCount matches the positive number of neighbours requested by KNN.
+func IsCount(expr *Expr) bool {
 	if token, status := Match(expr, "[0-9]+"); status {
-		value, _ := strconv.Atoi(token)
-		expr.data = Data{value: value}
+		k, err := strconv.Atoi(token)
+		if err == nil && k > 0 {
+			expr.k = k
+			return true
+		}
+	}
+	return expr.Fail("INVALID COUNT")
+}
+
+// IsEps matches an optional `EPS=<e>` clause, the error bound of an
+// approximate KNN. It succeeds without consuming anything when there is no
+// EPS.
+func IsEps(expr *Expr) bool {
+	position := expr.position
+	if _, status := Match(expr, `(?i)EPS\s*=`); !status {
+		expr.position = position
 		return true
 	}
-	expr.position = 0
-	return false
+	if token, status := Match(expr, Magnitude); status {
+		if eps, err := strconv.ParseFloat(token, 64); err == nil {
+			expr.eps = eps
+			return true
+		}
+	}
+	return expr.Fail("INVALID EPS")
+}
+
+// IsFilter matches an optional `WHERE data<op><value>` clause, where op is
+// >, < or =. It succeeds without consuming anything when there is no WHERE.
+func IsFilter(expr *Expr) bool {
+	position := expr.position
+	if _, status := Match(expr, `(?i)WHERE\b`); !status {
+		expr.position = position
+		return true
+	}
+	if token, status := Match(expr, `(?i)data\s*[<>=]\s*-?[0-9]+`); status {
+		token = strings.Replace(token[len("data"):], " ", "", -1)
+		value, err := strconv.Atoi(token[1:])
+		if err == nil {
+			expr.filter = Filter{op: token[:1], value: value}
+			return true
+		}
+	}
+	return expr.Fail("INVALID FILTER")
+}
+
+// IsOffset matches an optional `OFFSET <n>` clause, the number of results to
+// skip. It succeeds without consuming anything when there is no OFFSET.
+func IsOffset(expr *Expr) bool {
+	position := expr.position
+	if _, status := Match(expr, `(?i)OFFSET\b`); !status {
+		expr.position = position
+		return true
+	}
+	if token, status := Match(expr, "[0-9]+"); status {
+		if offset, err := strconv.Atoi(token); err == nil {
+			expr.offset = offset
+			return true
+		}
+	}
+	return expr.Fail("INVALID OFFSET")
+}
+
+// IsLimit matches an optional `LIMIT <n>` clause, the positive number of
+// results to return. It succeeds without consuming anything when there is no
+// LIMIT.
+func IsLimit(expr *Expr) bool {
+	position := expr.position
+	if _, status := Match(expr, `(?i)LIMIT\b`); !status {
+		expr.position = position
+		return true
+	}
+	if token, status := Match(expr, "[0-9]+"); status {
+		if limit, err := strconv.Atoi(token); err == nil && limit > 0 {
+			expr.limit = limit
+			return true
+		}
+	}
+	return expr.Fail("INVALID LIMIT")
+}
+
+// IsScore matches an optional SCORE flag, asking for the similarity score of
+// every KNN result.
+func IsScore(expr *Expr) bool {
+	position := expr.position
+	if _, status := Match(expr, `(?i)SCORE\b`); status {
+		expr.score = true
+		return true
+	}
+	expr.position = position
+	return true
+}
+
+// IsSort matches an optional `SORT <axis>` clause, the index of the
+// coordinate to order results by. It succeeds without consuming anything
+// when there is no SORT.
+func IsSort(expr *Expr) bool {
+	position := expr.position
+	if _, status := Match(expr, `(?i)SORT\b`); !status {
+		expr.position = position
+		return true
+	}
+	if token, status := Match(expr, "[0-9]+"); status {
+		if axis, err := strconv.Atoi(token); err == nil {
+			expr.axis = axis
+			expr.sorted = true
+			return true
+		}
+	}
+	return expr.Fail("INVALID AXIS")
+}
+
+// IsPath matches an optional file name. It succeeds without consuming
+// anything when there is none.
+func IsPath(expr *Expr) bool {
+	position := expr.position
+	if token, status := Match(expr, `\S+`); status {
+		expr.path = token
+		return true
+	}
+	expr.position = position
+	return true
+}
+
+// IsMode matches the name of a protocol mode.
+func IsMode(expr *Expr) bool {
+	if token, status := Match(expr, "(?i)JSON|TEXT"); status {
+		expr.mode = strings.ToUpper(token)
+		return true
+	}
+	return expr.Fail("INVALID MODE")
+}
+
+// IsMetric matches the name of a distance metric.
+func IsMetric(expr *Expr) bool {
+	if token, status := Match(expr, "(?i)EUCLIDEAN|MANHATTAN|CHEBYSHEV"); status {
+		expr.metric = strings.ToUpper(token)
+		return true
+	}
+	return expr.Fail("INVALID METRIC")
+}
+
+// IsFormat matches the name of a format points are exported in.
+func IsFormat(expr *Expr) bool {
+	if token, status := Match(expr, "(?i)GEOJSON"); status {
+		expr.format = strings.ToUpper(token)
+		return true
+	}
+	return expr.Fail("INVALID FORMAT")
+}
+
+// IsName matches the name of a namespace.
+func IsName(expr *Expr) bool {
+	if token, status := Match(expr, `[A-Za-z0-9_.-]+`); status {
+		expr.name = token
+		return true
+	}
+	return expr.Fail("INVALID NAME")
+}
+
+// IsToken matches a whitespace-free authentication token.
+func IsToken(expr *Expr) bool {
+	if token, status := Match(expr, `\S+`); status {
+		expr.token = token
+		return true
+	}
+	return expr.Fail("INVALID TOKEN")
+}
+
+// IsStamp matches the optional `@<time>` following the payload of a record,
+// the time the point was added in RFC 3339 format. It succeeds without
+// consuming anything when there is none.
+func IsStamp(expr *Expr) bool {
+	position := expr.position
+	token, status := Match(expr, `@\S+`)
+	if !status {
+		expr.position = position
+		return true
+	}
+	added, err := time.Parse(time.RFC3339Nano, token[1:])
+	if err != nil {
+		return expr.Fail("INVALID TIME")
+	}
+	expr.data.added = added
+	return true
+}
+
+// IsSince matches an optional `SINCE <seconds>` clause, selecting the points
+// added in the last so many seconds. The window is measured against the
+// system clock, so setting the clock back or forth widens or narrows it. It
+// succeeds without consuming anything when there is no SINCE.
+func IsSince(expr *Expr) bool {
+	position := expr.position
+	if _, status := Match(expr, `(?i)SINCE\b`); !status {
+		expr.position = position
+		return true
+	}
+	if token, status := Match(expr, Magnitude); status {
+		if seconds, err := strconv.ParseFloat(token, 64); err == nil && seconds < math.MaxInt64/float64(time.Second) {
+			expr.filter.since = time.Now().Add(-time.Duration(seconds * float64(time.Second)))
+			return true
+		}
+	}
+	return expr.Fail("INVALID SINCE")
 }
 
 func IsCommand(expr *Expr) bool {
-	return IsAction(expr) && IsPoint(expr) && IsData(expr)
+	return IsAction(expr) && IsPoint(expr) && IsData(expr) && IsStamp(expr)
 }
 
 func IsAddCommand(expr *Expr) bool {
 	rst := IsCommand(expr)
 	if expr.action == "ADD" {
-		return rst
+		return expr.Settle(rst)
 	}
 	expr.position = 0
 	return false
 }
 
-func IsKnnCommand(expr *Expr) bool {
+func IsUpdateCommand(expr *Expr) bool {
 	rst := IsCommand(expr)
+	if expr.action == "UPDATE" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+func IsKnnCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsCount(expr) && IsEps(expr) && IsFilter(expr) && IsSince(expr) && IsOffset(expr) && IsLimit(expr) && IsScore(expr)
 	if expr.action == "KNN" {
-		return rst
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsFknnCommand matches FKNN followed by a point and the number of farthest
+// points to find.
+func IsFknnCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsCount(expr)
+	if expr.action == "FKNN" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsMknnCommand matches MKNN followed by the number of neighbours to find for
+// each of the points sent on the lines that follow, up to END.
+func IsMknnCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsCount(expr)
+	if expr.action == "MKNN" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsKdistCommand matches KDIST followed by a point and the k of the
+// neighbour whose distance is requested.
+func IsKdistCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsCount(expr)
+	if expr.action == "KDIST" {
+		return expr.Settle(rst)
 	}
 	expr.position = 0
 	return false
@@ -139,97 +724,1375 @@ func IsPartialCommand(expr *Expr) bool {
 func IsDelCommand(expr *Expr) bool {
 	rst := IsPartialCommand(expr)
 	if expr.action == "DEL" {
-		return rst
+		return expr.Settle(rst)
 	}
 	expr.position = 0
 	return false
 }
 
-func IsFullCommand(expr *Expr) bool {
-	return IsAddCommand(expr) || IsKnnCommand(expr)
+func IsGetCommand(expr *Expr) bool {
+	rst := IsPartialCommand(expr)
+	if expr.action == "GET" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
 }
 
-func ParseKDtreeCommand(command string) Expr {
-	command = strings.TrimSpace(command)
-	var expr Expr
-	expr.buffer = command
-	expr.valid = false
-	valid := IsFullCommand(&expr) || IsDelCommand(&expr) || IsEndAction(&expr)
-	if valid {
-		expr.valid = true
+func IsNearestCommand(expr *Expr) bool {
+	rst := IsPartialCommand(expr)
+	if expr.action == "NEAREST" {
+		return expr.Settle(rst)
 	}
-	return expr
+	expr.position = 0
+	return false
 }
 
-func MakePoint(p string) []float64 {
-	re := regexp.MustCompile("[0-9]+")
-	rst := re.FindAllString(p, -1)
-	x, _ := strconv.Atoi(rst[0])
-	y, _ := strconv.Atoi(rst[1])
-	return []float64{float64(x), float64(y)}
+func IsRangeCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsBound(expr) && IsSince(expr) && IsSort(expr)
+	if expr.action == "RANGE" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
 }
 
-func HandleRequest(connection net.Conn, store *KdtreeStore) {
-	connection.Write([]byte("Connected to kdtreed...\r\n"))
-	for {
-		data, err := bufio.NewReader(connection).ReadString('\n')
-		if err != nil {
-			connection.Write([]byte("READ ERROR\r\n"))
-			continue
-		}
+// IsCentroidCommand matches CENTROID followed by the two corners of the box
+// to average the points of.
+func IsCentroidCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsBound(expr)
+	if expr.action == "CENTROID" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
 
-		parsed := ParseKDtreeCommand(data)
-		if !parsed.valid {
-			connection.Write([]byte("INVALID COMMAND\r\n"))
-			continue
-		}
-		if parsed.valid && parsed.action == "END" {
-			connection.Write([]byte("BYE!!!\r\n"))
-			break
-		}
+func IsDelRangeCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsBound(expr)
+	if expr.action == "DELRANGE" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
 
-		switch parsed.action {
-		case "ADD":
-			store.Lock()
-			store.tree.Insert(points.NewPoint(parsed.point, parsed.data))
-			store.Unlock()
-			connection.Write([]byte(fmt.Sprintf("%+v added\r\n", parsed.point)))
-		case "DEL":
-			store.Lock()
-			store.tree.Remove(&points.Point{Coordinates: parsed.point})
-			store.Unlock()
-			connection.Write([]byte(fmt.Sprintf("%+v deleted\r\n", parsed.point)))
-		case "KNN":
-			rst := store.tree.KNN(&points.Point{Coordinates: parsed.point}, parsed.data.value)
-			connection.Write([]byte(fmt.Sprintf("%+v\r\n", rst)))
-		}
+func IsBallCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsRadius(expr)
+	if expr.action == "BALL" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
 
+func IsCountBallCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPoint(expr) && IsRadius(expr)
+	if expr.action == "COUNTBALL" {
+		return expr.Settle(rst)
 	}
-	connection.Close()
+	expr.position = 0
+	return false
 }
 
-func main() {
-	fname := flag.String("config", "config.toml", "-config=<file_name>")
+func IsModeCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsMode(expr)
+	if expr.action == "MODE" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+func IsMetricCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsMetric(expr)
+	if expr.action == "METRIC" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsExportCommand matches EXPORT followed by the format to write the points
+// in.
+func IsExportCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsFormat(expr)
+	if expr.action == "EXPORT" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+func IsImportCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsFormat(expr)
+	if expr.action == "IMPORT" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsUseCommand matches USE followed by the name of the namespace to switch
+// the connection to.
+func IsUseCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsName(expr)
+	if expr.action == "USE" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+func IsAuthCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsToken(expr)
+	if expr.action == "AUTH" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsBulkCommand matches BULK followed by the number of records to load,
+// which are sent on the lines that follow.
+func IsBulkCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsCount(expr)
+	if expr.action == "BULK" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsSwapCommand matches SWAP followed by the number of records to replace
+// the points with, sent as for BULK.
+func IsSwapCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsCount(expr)
+	if expr.action == "SWAP" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+// IsBenchCommand matches BENCH followed by the number of queries to run and
+// optionally their error bound.
+func IsBenchCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsCount(expr) && IsEps(expr)
+	if expr.action == "BENCH" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+func IsSaveCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPath(expr)
+	if expr.action == "SAVE" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+func IsLoadCommand(expr *Expr) bool {
+	rst := IsAction(expr) && IsPath(expr)
+	if expr.action == "LOAD" {
+		return expr.Settle(rst)
+	}
+	expr.position = 0
+	return false
+}
+
+func IsFullCommand(expr *Expr) bool {
+	return IsAddCommand(expr) || IsUpdateCommand(expr) || IsKnnCommand(expr) || IsKdistCommand(expr)
+}
+
+func ParseKDtreeCommand(command string) Expr {
+	command = strings.TrimSpace(command)
+	var expr Expr
+	expr.buffer = command
+	expr.valid = false
+	// Lines starting with # are comments, so that scripts of commands can
+	// be annotated. They are told apart before any action is matched.
+	if command == "" || strings.HasPrefix(command, "#") {
+		expr.valid = true
+		expr.comment = true
+		return expr
+	}
+	valid := IsFullCommand(&expr) || IsMknnCommand(&expr) || IsFknnCommand(&expr) || IsDelCommand(&expr) || IsGetCommand(&expr) || IsNearestCommand(&expr) || IsRangeCommand(&expr) || IsDelRangeCommand(&expr) || IsCentroidCommand(&expr) || IsBallCommand(&expr) || IsCountBallCommand(&expr) ||
+		IsCountAction(&expr) || IsBoundsAction(&expr) || IsClearAction(&expr) || IsSaveCommand(&expr) || IsLoadCommand(&expr) ||
+		IsPingAction(&expr) || IsStatsAction(&expr) || IsDepthAction(&expr) || IsRebalanceAction(&expr) || IsDrainAction(&expr) || IsDumpAction(&expr) || IsExportCommand(&expr) || IsImportCommand(&expr) ||
+		IsBeginAction(&expr) || IsCommitAction(&expr) || IsAbortAction(&expr) || IsModeCommand(&expr) || IsMetricCommand(&expr) || IsUseCommand(&expr) || IsAuthCommand(&expr) ||
+		IsBulkCommand(&expr) || IsSwapCommand(&expr) || IsBenchCommand(&expr) || IsHelpAction(&expr) || IsVersionAction(&expr) || IsEndAction(&expr)
+	// The parsers stop as soon as the grammar of the action is matched, so
+	// whatever is left of the line was not part of the command.
+	if valid && strings.TrimSpace(expr.Current()) != "" {
+		expr.SkipWhitespace()
+		expr.stop = expr.position
+		expr.err = "TRAILING GARBAGE"
+		valid = false
+	}
+	if valid {
+		expr.valid = true
+	}
+	return expr
+}
+
+// coordinates matches every coordinate of a point for MakePoint.
+var coordinates = regexp.MustCompile(Coordinate)
+
+// MakePoint parses the coordinates of a point matched by Point, or the
+// numbers of a Vector. It fails on
+// coordinates out of the range of a float64, such as 1e999, rather than
+// storing them as infinities.
+func MakePoint(p string) ([]float64, error) {
+	rst := coordinates.FindAllString(p, -1)
+	point := make([]float64, len(rst))
+	for i, coord := range rst {
+		x, err := strconv.ParseFloat(coord, 64)
+		if err != nil {
+			return nil, err
+		}
+		point[i] = x
+	}
+	return point, nil
+}
+
+// Page returns the window of results selected by an OFFSET and a LIMIT,
+// where a limit of 0 selects every result after the offset.
+func Page(rst []kdtree.Point, offset int, limit int) []kdtree.Point {
+	if offset > len(rst) {
+		offset = len(rst)
+	}
+	rst = rst[offset:]
+	if limit > 0 && limit < len(rst) {
+		rst = rst[:limit]
+	}
+	return rst
+}
+
+// FormatNeighbour renders a KNN result as `{x, y, ...} data=.. dist=..`,
+// where dist is its distance from the query point, followed by `score=..`
+// when score is not nil.
+func FormatNeighbour(query []float64, p kdtree.Point, distance DistanceFunc, score func(float64) float64) string {
+	point := p.(*points.Point)
+	dist := UnscaleDistance(distance(query, point.Coordinates))
+	rst := fmt.Sprintf("%s data=%v dist=%s", FormatPoint(point.Coordinates), point.Data,
+		strconv.FormatFloat(dist, 'g', -1, 64))
+	if score != nil {
+		rst += " score=" + strconv.FormatFloat(score(dist), 'g', -1, 64)
+	}
+	return rst
+}
+
+// Add registers a new connection. It returns false once Shutdown has been
+// called, in which case the caller must not serve the connection.
+func (conns *Connections) Add(connection net.Conn) bool {
+	conns.Lock()
+	defer conns.Unlock()
+	if conns.closing {
+		return false
+	}
+	if conns.active == nil {
+		conns.active = make(map[net.Conn]bool)
+	}
+	conns.active[connection] = true
+	conns.wg.Add(1)
+	return true
+}
+
+// Done unregisters a connection once its handler has returned.
+func (conns *Connections) Done(connection net.Conn) {
+	conns.Lock()
+	delete(conns.active, connection)
+	conns.Unlock()
+	conns.wg.Done()
+}
+
+// Shutdown notifies and closes every open connection, then waits for their
+// handlers to return. Connections added afterwards are refused.
+func (conns *Connections) Shutdown(config *ServerConfig) {
+	conns.Lock()
+	conns.closing = true
+	for connection := range conns.active {
+		TextConn(connection, config).Write([]byte("SHUTTING DOWN\r\n"))
+		connection.Close()
+	}
+	conns.Unlock()
+	conns.wg.Wait()
+}
+
+// LineConn ends the lines written to the connection with a bare LF. The
+// daemon writes CRLF-terminated responses throughout, and connections are
+// wrapped in a LineConn when line_ending is lf.
+type LineConn struct {
+	net.Conn
+	// cr is set when the last write ended with a CR, which is held back in
+	// case the next write starts with the LF ending the line.
+	cr bool
+}
+
+func (conn *LineConn) Write(p []byte) (int, error) {
+	buf := p
+	if conn.cr {
+		buf = append([]byte{'\r'}, p...)
+	}
+	conn.cr = len(buf) > 0 && buf[len(buf)-1] == '\r'
+	if conn.cr {
+		buf = buf[:len(buf)-1]
+	}
+	if _, err := conn.Conn.Write(bytes.Replace(buf, []byte("\r\n"), []byte("\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Tag matches the optional integer tag leading a command.
+var Tag = regexp.MustCompile(`^\s*([0-9]+)\s+`)
+
+// SplitTag separates the optional tag from a command line.
+func SplitTag(line string) (string, string) {
+	if loc := Tag.FindStringSubmatchIndex(line); loc != nil {
+		return line[loc[2]:loc[3]], line[loc[1]:]
+	}
+	return "", line
+}
+
+// TaggedConn writes every response line of a tagged command to the
+// connection prefixed by the tag.
+type TaggedConn struct {
+	net.Conn
+	tag string
+	// midLine is set while the last write did not end a line.
+	midLine bool
+}
+
+func (conn *TaggedConn) Write(p []byte) (int, error) {
+	var tagged []byte
+	for _, b := range p {
+		if !conn.midLine {
+			tagged = append(tagged, conn.tag+" "...)
+			conn.midLine = true
+		}
+		tagged = append(tagged, b)
+		if b == '\n' {
+			conn.midLine = false
+		}
+	}
+	if _, err := conn.Conn.Write(tagged); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ErrLineTooLong is returned by ReadLine for lines over the length limit.
+var ErrLineTooLong = errors.New("line too long")
+
+// ReadLine reads a line of at most max bytes, newline included, or of any
+// length if max is 0. The rest of a longer line is read and discarded before
+// ErrLineTooLong is returned, so that the next read starts on the next line.
+func ReadLine(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			tooLong = max > 0 && len(line) > max
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil:
+			return string(line), err
+		case tooLong:
+			return "", ErrLineTooLong
+		}
+		return string(line), nil
+	}
+}
+
+func HandleRequest(connection net.Conn, namespaces *Namespaces, config *ServerConfig, limiter *Limiter) {
+	// store is the store of the namespace selected with USE, which JSON
+	// requests go to as well.
+	store := namespaces.Get(DefaultNamespace)
+	// JSON responses carry their status themselves, so only text responses
+	// get status codes.
+	text := TextConn(connection, config)
+	// A panic serving a command closes its connection only, instead of the
+	// daemon and every other connection with it.
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("panic serving connection", "remote", connection.RemoteAddr(), "panic", r, "stack", string(debug.Stack()))
+			text.Write([]byte("ERROR\r\n"))
+			connection.Close()
+		}
+	}()
+	if !config.QuietConnect {
+		text.Write([]byte(config.Banner + "\r\n"))
+	}
+	// The reader is shared across commands: it may buffer past the current
+	// newline, so pipelined commands would be lost with a per-line reader.
+	reader := bufio.NewReader(connection)
+	session := Session{authenticated: config.AuthToken == "", metric: config.Metric(), namespace: DefaultNamespace}
+	for {
+		if timeout := atomic.LoadInt64(&readTimeout); timeout > 0 {
+			connection.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
+		data, err := ReadLine(reader, config.MaxLineLength)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			logger.Info("connection timed out", "remote", connection.RemoteAddr())
+			text.Write([]byte("TIMEOUT\r\n"))
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err == ErrLineTooLong {
+			logger.Warn("command too long", "remote", connection.RemoteAddr(), "limit", config.MaxLineLength)
+			text.Write([]byte("LINE TOO LONG\r\n"))
+			continue
+		}
+		if err != nil {
+			logger.Debug("cannot read command", "remote", connection.RemoteAddr(), "error", err)
+			if _, err := text.Write([]byte("READ ERROR\r\n")); err != nil {
+				// The connection is gone, e.g. closed on shutdown.
+				break
+			}
+			continue
+		}
+
+		atomic.AddUint64(&store.commands, 1)
+		// A tagged command is answered with every response line prefixed
+		// by its tag, so that pipelining clients can match the replies.
+		var out net.Conn = connection
+		tag, data := SplitTag(data)
+		if tag != "" {
+			out = &TaggedConn{Conn: connection, tag: tag}
+		}
+		if !session.jsonMode {
+			out = TextConn(out, config)
+		}
+		written := &CountingConn{Conn: out}
+		out = written
+		if limiter.Delays() {
+			time.Sleep(limiter.Delay(ClientKey(connection)))
+		} else if !limiter.Allow(ClientKey(connection)) {
+			out.Write([]byte("RATE LIMITED\r\n"))
+			accessLog.Record(written, "", nil)
+			continue
+		}
+		if session.jsonMode {
+			start := time.Now()
+			response, op := ExecuteJSON(data, store, config, &session)
+			logger.Debug("command", "remote", connection.RemoteAddr(), "command", strings.TrimSpace(data),
+				"op", op, "ok", response["ok"], "error", response["error"])
+			encoded, _ := json.Marshal(response)
+			out.Write(append(encoded, "\r\n"...))
+			written.code = http.StatusOK
+			if message, failed := response["error"].(string); failed {
+				written.code = protocol.StatusCode(message)
+			}
+			if op == "" || op == "end" {
+				accessLog.Record(written, op, nil)
+			} else {
+				Observe(store, written, op, data, RequestPoint(data), start)
+			}
+			if op == "end" {
+				break
+			}
+			continue
+		}
+
+		parsed := ParseKDtreeCommand(data)
+		logger.Debug("command", "remote", connection.RemoteAddr(), "command", strings.TrimSpace(data),
+			"action", parsed.action, "valid", parsed.valid, "error", parsed.err)
+		if parsed.comment {
+			continue
+		}
+		if !parsed.valid {
+			if parsed.err == "" {
+				parsed.err = "INVALID COMMAND"
+				if near := parsed.Near(); near != "" {
+					parsed.err += fmt.Sprintf(" near '%s'", near)
+				}
+			}
+			out.Write([]byte(parsed.err + "\r\n"))
+			accessLog.Record(written, "", nil)
+			continue
+		}
+		if parsed.valid && parsed.action == "END" {
+			out.Write([]byte("BYE!!!\r\n"))
+			accessLog.Record(written, parsed.action, nil)
+			break
+		}
+
+		if !session.Allows(parsed.action) {
+			out.Write([]byte("UNAUTHORIZED\r\n"))
+			accessLog.Record(written, parsed.action, parsed.point)
+			continue
+		}
+		// The session commands are recorded in the access log only, as
+		// they do not reach the store.
+		if parsed.action == "AUTH" {
+			if !session.Authenticate(config, parsed.token) {
+				logger.Warn("authentication failed", "remote", connection.RemoteAddr())
+				out.Write([]byte("UNAUTHORIZED\r\n"))
+				accessLog.Record(written, parsed.action, nil)
+				continue
+			}
+			out.Write([]byte("OK\r\n"))
+			accessLog.Record(written, parsed.action, nil)
+			continue
+		}
+		if parsed.action == "METRIC" {
+			session.metric = parsed.metric
+			out.Write([]byte("METRIC " + parsed.metric + "\r\n"))
+			accessLog.Record(written, parsed.action, nil)
+			continue
+		}
+		if parsed.action == "USE" {
+			// The commands of a batch are applied to the store they
+			// are committed to, so the store cannot change midway.
+			if session.inBatch {
+				out.Write([]byte("INVALID IN BATCH\r\n"))
+			} else {
+				store = namespaces.Get(parsed.name)
+				session.namespace = parsed.name
+				out.Write([]byte("USE " + parsed.name + "\r\n"))
+			}
+			accessLog.Record(written, parsed.action, nil)
+			continue
+		}
+		if parsed.action == "DRAIN" {
+			ExecuteDrain(out, namespaces, config)
+			accessLog.Record(written, parsed.action, nil)
+			continue
+		}
+		if parsed.action == "MODE" {
+			session.jsonMode = parsed.mode == "JSON"
+			out.Write([]byte("MODE " + parsed.mode + "\r\n"))
+			accessLog.Record(written, parsed.action, nil)
+			continue
+		}
+
+		start := time.Now()
+		// The commands followed by records read them even in a batch,
+		// which they cannot be part of, so that the records are not taken
+		// for commands.
+		if parsed.action == "BULK" || parsed.action == "SWAP" {
+			ExecuteBulk(out, reader, store, config, &session, parsed.action, parsed.k)
+			Observe(store, written, parsed.action, data, parsed.point, start)
+			continue
+		}
+		if parsed.action == "IMPORT" {
+			ExecuteImport(out, reader, store, config, &session)
+			Observe(store, written, parsed.action, data, parsed.point, start)
+			continue
+		}
+		if parsed.action == "BEGIN" || parsed.action == "COMMIT" || parsed.action == "ABORT" ||
+			session.inBatch && Mutations[parsed.action] {
+			ExecuteBatch(out, store, config, &session, parsed)
+			Observe(store, written, parsed.action, data, parsed.point, start)
+			continue
+		}
+		if parsed.action == "MKNN" {
+			ExecuteMultiKNN(out, reader, store, config, &session, parsed.k)
+			Observe(store, written, parsed.action, data, parsed.point, start)
+			continue
+		}
+		if config.ReadOnly && Mutations[parsed.action] {
+			out.Write([]byte(ErrorResponse(ErrReadOnly) + "\r\n"))
+			accessLog.Record(written, parsed.action, parsed.point)
+			continue
+		}
+		ExecuteCommand(out, store, config, &session, parsed)
+		Observe(store, written, parsed.action, data, parsed.point, start)
+	}
+	logger.Debug("closed connection", "remote", connection.RemoteAddr())
+	connection.Close()
+}
+
+// Batchable are the mutations that can be queued between BEGIN and COMMIT.
+var Batchable = map[string]bool{"ADD": true, "UPDATE": true, "DEL": true, "CLEAR": true}
+
+// ExecuteBatch runs BEGIN, COMMIT and ABORT, and queues the mutations sent
+// in between. Batchable mutations are queued and applied at once on COMMIT,
+// while queries are answered straight away, from the store as it was before
+// the batch. Other mutations are rejected.
+func ExecuteBatch(connection net.Conn, store *KdtreeStore, config *ServerConfig, session *Session, parsed Expr) {
+	switch parsed.action {
+	case "BEGIN":
+		if session.inBatch {
+			connection.Write([]byte("ALREADY IN BATCH\r\n"))
+			return
+		}
+		session.inBatch, session.batch = true, nil
+		connection.Write([]byte("OK\r\n"))
+	case "ABORT":
+		if !session.inBatch {
+			connection.Write([]byte("NO BATCH\r\n"))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("ABORTED %d\r\n", len(session.batch))))
+		session.inBatch, session.batch = false, nil
+	case "COMMIT":
+		if !session.inBatch {
+			connection.Write([]byte("NO BATCH\r\n"))
+			return
+		}
+		batch := session.batch
+		session.inBatch, session.batch = false, nil
+		n, err := store.Commit(batch)
+		if err == ErrWalFailed {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if err != nil {
+			// n is the index of the command that failed and made the
+			// whole batch fail.
+			connection.Write([]byte(fmt.Sprintf("FAILED %d %s\r\n", n+1, ErrorResponse(err))))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("COMMITTED %d\r\n", n)))
+	default:
+		if config.ReadOnly {
+			connection.Write([]byte(ErrorResponse(ErrReadOnly) + "\r\n"))
+			return
+		}
+		if !Batchable[parsed.action] {
+			connection.Write([]byte("INVALID IN BATCH\r\n"))
+			return
+		}
+		session.batch = append(session.batch, parsed)
+		connection.Write([]byte("QUEUED\r\n"))
+	}
+}
+
+// ExecuteDrain makes every namespace read-only for good and then saves the
+// default one to the data file, if any, for a new instance to take over
+// from once this one is shut down. The answer is the number of points of
+// the default namespace, saved or not.
+func ExecuteDrain(connection net.Conn, namespaces *Namespaces, config *ServerConfig) {
+	namespaces.Drain()
+	store := namespaces.Get(DefaultNamespace)
+	if config.DataFile == "" {
+		count, _ := store.Stats()
+		logger.Warn("drained, without a data file to save to", "points", count)
+		connection.Write([]byte(fmt.Sprintf("DRAINED %d\r\n", count)))
+		return
+	}
+	count, err := store.Save(config.DataFile, true)
+	if err != nil {
+		logger.Error("drained, but cannot save snapshot", "file", config.DataFile, "error", err)
+		connection.Write([]byte("SAVE FAILED\r\n"))
+		return
+	}
+	logger.Warn("drained, the store is read-only until restarted", "file", config.DataFile, "points", count)
+	connection.Write([]byte(fmt.Sprintf("DRAINED %d\r\n", count)))
+}
+
+// ExecuteBulk reads the count records following a BULK or SWAP command, in
+// the format of the data file, and loads them into the store at once, in
+// addition to the stored points for BULK and in place of them for SWAP.
+// Every record is read even if an earlier one is invalid, so that none of
+// them is mistaken for a command; a single invalid record rejects the whole
+// batch, as does a read-only server or a session in a batch.
+func ExecuteBulk(connection net.Conn, reader *bufio.Reader, store *KdtreeStore, config *ServerConfig, session *Session, action string, count int) {
+	pts := []kdtree.Point{}
+	invalid := 0
+	for line := 1; line <= count; line++ {
+		record, err := ReadLine(reader, config.MaxLineLength)
+		if err != nil {
+			logger.Debug("cannot read bulk record", "remote", connection.RemoteAddr(), "error", err)
+			connection.Write([]byte("READ ERROR\r\n"))
+			return
+		}
+		expr := ParseKDtreeCommand("ADD " + record)
+		if !expr.valid || expr.action != "ADD" {
+			if invalid == 0 {
+				invalid = line
+			}
+			continue
+		}
+		pts = append(pts, points.NewPoint(expr.point, expr.data))
+	}
+	if session.inBatch {
+		connection.Write([]byte("INVALID IN BATCH\r\n"))
+		return
+	}
+	if invalid > 0 {
+		connection.Write([]byte(fmt.Sprintf("INVALID RECORD %d\r\n", invalid)))
+		return
+	}
+	if config.ReadOnly {
+		connection.Write([]byte(ErrorResponse(ErrReadOnly) + "\r\n"))
+		return
+	}
+	if action == "SWAP" {
+		if err := store.Swap(pts); err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("SWAPPED %d\r\n", len(pts))))
+		return
+	}
+	if err := store.Bulk(pts); err != nil {
+		connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+		return
+	}
+	connection.Write([]byte(fmt.Sprintf("BULK %d added\r\n", len(pts))))
+}
+
+// streamChunk is the size of the chunks streamed RANGE results are written
+// in.
+const streamChunk = 32 * 1024
+
+// DeadlineConn gives every write to a connection a deadline of timeout from
+// the time it starts, so that a client that stops reading fails the write
+// rather than blocking it; a zero timeout sets no deadline.
+type DeadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn DeadlineConn) Write(p []byte) (int, error) {
+	if conn.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	}
+	return conn.Conn.Write(p)
+}
+
+// ExecuteCommand runs a valid command against the store and writes the
+// response to the connection.
+func ExecuteCommand(connection net.Conn, store *KdtreeStore, config *ServerConfig, session *Session, parsed Expr) {
+	switch parsed.action {
+	case "DEPTH":
+		depth, optimal := store.DepthStats()
+		ratio := 0.0
+		if optimal > 0 {
+			ratio = float64(depth) / float64(optimal)
+		}
+		connection.Write([]byte(fmt.Sprintf("DEPTH depth=%d optimal=%d ratio=%.2f\r\n", depth, optimal, ratio)))
+	case "VERSION":
+		connection.Write([]byte(VersionString() + "\r\n"))
+	case "HELP":
+		for _, line := range Help() {
+			connection.Write([]byte(line + "\r\n"))
+		}
+		connection.Write([]byte("END\r\n"))
+	case "PING":
+		// A liveness probe: answered without touching the store.
+		connection.Write([]byte("PONG\r\n"))
+	case "ADD":
+		if err := store.Add(parsed.point, parsed.data); err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte(FormatPoint(parsed.point) + " added\r\n"))
+	case "UPDATE":
+		if err := store.Update(parsed.point, parsed.data); err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte("UPDATED\r\n"))
+	case "DEL":
+		if err := store.Delete(parsed.point); err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte(FormatPoint(parsed.point) + " deleted\r\n"))
+	case "KNN":
+		rst, err := store.FilteredKNN(parsed.point, parsed.k, session.metric, parsed.eps, parsed.filter)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		// KNN lists up to k neighbours: fewer when the tree holds fewer
+		// points, or fewer matching the filter, and EMPTY when there are
+		// none to list at all.
+		rst = Page(rst, parsed.offset, parsed.limit)
+		if len(rst) == 0 {
+			connection.Write([]byte("EMPTY\r\n"))
+			return
+		}
+		var score func(float64) float64
+		if parsed.score {
+			score = config.Score
+		}
+		for _, p := range rst {
+			connection.Write([]byte(FormatNeighbour(parsed.point, p, DistanceMetrics[session.metric], score) + "\r\n"))
+		}
+		connection.Write([]byte("END\r\n"))
+	case "FKNN":
+		rst, err := store.FarthestKNN(parsed.point, parsed.k, session.metric)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if len(rst) == 0 {
+			connection.Write([]byte("EMPTY\r\n"))
+			return
+		}
+		for _, p := range rst {
+			connection.Write([]byte(FormatNeighbour(parsed.point, p, DistanceMetrics[session.metric], nil) + "\r\n"))
+		}
+		connection.Write([]byte("END\r\n"))
+	case "GET":
+		p, err := store.Get(parsed.point)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte("GET " + FormatRecord(p) + "\r\n"))
+	case "KDIST":
+		// KDIST answers with the distance alone, sparing density
+		// estimates over many query points the neighbours themselves.
+		distance, ok, err := store.KDist(parsed.point, parsed.k, session.metric)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if !ok {
+			connection.Write([]byte("EMPTY\r\n"))
+			return
+		}
+		connection.Write([]byte("KDIST " + strconv.FormatFloat(distance, 'g', -1, 64) + "\r\n"))
+	case "NEAREST":
+		rst, err := store.KNN(parsed.point, 1, session.metric)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if len(rst) == 0 {
+			connection.Write([]byte("EMPTY\r\n"))
+			return
+		}
+		connection.Write([]byte("NEAREST " + FormatRecord(rst[0]) + "\r\n"))
+	case "RANGE":
+		if !parsed.sorted {
+			// Unsorted results are written in chunks as the traversal of
+			// the tree finds them, so the first arrive before the search
+			// is over and no more than a chunk is kept in memory. The
+			// traversal holds the read lock, so every chunk must be taken
+			// within the write timeout, or the walk is abandoned and the
+			// connection closed rather than writers held up.
+			chunks := bufio.NewWriterSize(DeadlineConn{connection, time.Duration(config.WriteTimeout) * time.Second}, streamChunk)
+			var failed error
+			err := store.StreamRange(parsed.point, parsed.bound, parsed.filter, func(p kdtree.Point) bool {
+				_, failed = chunks.WriteString(FormatRecord(p) + "\r\n")
+				return failed == nil
+			})
+			if failed == nil {
+				failed = chunks.Flush()
+			}
+			connection.SetWriteDeadline(time.Time{})
+			if failed != nil {
+				logger.Warn("abandoning RANGE", "remote", connection.RemoteAddr(), "error", failed)
+				connection.Close()
+				return
+			}
+			if err != nil {
+				connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+				return
+			}
+			connection.Write([]byte("END\r\n"))
+			return
+		}
+		// The axis is checked before the search, against the dimension
+		// of the tree, which is unknown while it is empty.
+		if _, dimension := store.Stats(); dimension > 0 && parsed.axis >= dimension {
+			connection.Write([]byte("INVALID AXIS\r\n"))
+			return
+		}
+		rst, err := store.Range(parsed.point, parsed.bound)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		kept := rst[:0]
+		for _, p := range rst {
+			if parsed.filter.Matches(p.(*points.Point).Data.(Data)) {
+				kept = append(kept, p)
+			}
+		}
+		rst = kept
+		sort.SliceStable(rst, func(i, j int) bool {
+			return rst[i].Dimension(parsed.axis) < rst[j].Dimension(parsed.axis)
+		})
+		for _, p := range rst {
+			connection.Write([]byte(FormatRecord(p) + "\r\n"))
+		}
+		connection.Write([]byte("END\r\n"))
+	case "DELRANGE":
+		count, err := store.DeleteRange(parsed.point, parsed.bound)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("DELETED %d\r\n", count)))
+	case "BALL":
+		rst, err := store.Ball(parsed.point, parsed.radius, session.metric)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		for _, p := range rst {
+			connection.Write([]byte(FormatRecord(p) + "\r\n"))
+		}
+		connection.Write([]byte("END\r\n"))
+	case "BOUNDS":
+		lower, upper, ok := store.Bounds()
+		if !ok {
+			connection.Write([]byte("EMPTY\r\n"))
+			return
+		}
+		connection.Write([]byte("BOUNDS " + FormatPoint(lower) + " " + FormatPoint(upper) + "\r\n"))
+	case "CENTROID":
+		centroid, count, err := store.Centroid(parsed.point, parsed.bound)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if count == 0 {
+			connection.Write([]byte("EMPTY\r\n"))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("CENTROID %s %d\r\n", FormatPoint(centroid), count)))
+	case "COUNTBALL":
+		count, err := store.CountBall(parsed.point, parsed.radius, session.metric)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("COUNT %d\r\n", count)))
+	case "DUMP":
+		// The records are written in the data file format, so a dump can
+		// be loaded back with BULK or as a data file.
+		writer := bufio.NewWriter(connection)
+		for _, p := range store.Dump() {
+			writer.WriteString(FormatStamped(p) + "\r\n")
+		}
+		writer.WriteString("END\r\n")
+		writer.Flush()
+	case "EXPORT":
+		pts := store.Dump()
+		if len(pts) > 0 && len(pts[0].(*points.Point).Coordinates) != 2 {
+			connection.Write([]byte("NOT 2D\r\n"))
+			return
+		}
+		// The document is followed by END, as it spans several lines.
+		writer := bufio.NewWriter(connection)
+		if err := WriteGeoJSON(writer, pts); err != nil {
+			logger.Error("cannot export tree", "format", parsed.format, "error", err)
+			// The error ends the document cut short in place of END.
+			writer.WriteString(ErrorResponse(err) + "\r\n")
+			writer.Flush()
+			return
+		}
+		connection.Write([]byte("END\r\n"))
+	case "COUNT":
+		count, _ := store.Stats()
+		connection.Write([]byte(fmt.Sprintf("COUNT %d\r\n", count)))
+	case "STATS":
+		count, dimension := store.Stats()
+		connection.Write([]byte(fmt.Sprintf("STATS points=%d dimension=%d uptime=%d commands=%d\r\n",
+			count, dimension, int(time.Since(startTime).Seconds()), atomic.LoadUint64(&store.commands))))
+	case "REBALANCE":
+		connection.Write([]byte(fmt.Sprintf("REBALANCED %d\r\n", store.Rebalance())))
+	case "BENCH":
+		if config.BenchMax > 0 && parsed.k > config.BenchMax {
+			connection.Write([]byte(ErrorResponse(ErrTooLarge) + "\r\n"))
+			return
+		}
+		result, ok, err := Bench(store, parsed.k, int64(config.BenchSeed), session.metric, parsed.eps)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if !ok {
+			connection.Write([]byte("EMPTY\r\n"))
+			return
+		}
+		connection.Write([]byte("BENCH " + result.String() + "\r\n"))
+	case "CLEAR":
+		if err := store.Clear(); err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		connection.Write([]byte("CLEARED\r\n"))
+	case "SAVE":
+		// Both SAVE and LOAD default to the data file in the default
+		// namespace. Saving to it also checkpoints the write-ahead log.
+		fname, checkpoint, err := session.SnapshotFile(config, parsed.path)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if fname == "" {
+			connection.Write([]byte("NO DATA FILE\r\n"))
+			return
+		}
+		count, err := store.Save(fname, checkpoint)
+		if err != nil {
+			logger.Error("cannot save tree", "file", fname, "error", err)
+			connection.Write([]byte("SAVE FAILED\r\n"))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("SAVED %d\r\n", count)))
+	case "LOAD":
+		fname, _, err := session.SnapshotFile(config, parsed.path)
+		if err != nil {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		if fname == "" {
+			connection.Write([]byte("NO DATA FILE\r\n"))
+			return
+		}
+		count, err := store.Load(fname)
+		if errors.Is(err, ErrWalFailed) || errors.Is(err, ErrReadOnly) {
+			connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+			return
+		}
+		var unsupported *UnsupportedFormatError
+		if errors.As(err, &unsupported) {
+			connection.Write([]byte("UNSUPPORTED FORMAT " + unsupported.Version + "\r\n"))
+			return
+		}
+		if err != nil {
+			logger.Error("cannot load tree", "file", fname, "error", err)
+			connection.Write([]byte("LOAD FAILED\r\n"))
+			return
+		}
+		connection.Write([]byte(fmt.Sprintf("LOADED %d\r\n", count)))
+	}
+}
+
+// ExecuteMultiKNN reads the query points following an MKNN command, one per
+// line up to END, and answers all of them at once. The neighbours of every
+// query follow a `QUERY <n> {x, y, ...}` line, n counting from 1, in the
+// format of KNN, and END follows the last of them; a query without
+// neighbours has none listed. Every line is read even if an earlier one is
+// invalid, so that none of them is mistaken for a command, and a single
+// invalid point rejects them all. Past MknnMax points the rest cannot be
+// told apart from commands without reading them, so the connection is
+// closed instead.
+func ExecuteMultiKNN(connection net.Conn, reader *bufio.Reader, store *KdtreeStore, config *ServerConfig, session *Session, k int) {
+	queries := [][]float64{}
+	invalid := 0
+	for line := 1; ; line++ {
+		record, err := ReadLine(reader, config.MaxLineLength)
+		if err != nil {
+			logger.Debug("cannot read query point", "remote", connection.RemoteAddr(), "error", err)
+			connection.Write([]byte("READ ERROR\r\n"))
+			return
+		}
+		if strings.TrimSpace(record) == "END" {
+			break
+		}
+		if TooLarge(line, config.MknnMax) {
+			connection.Write([]byte(ErrorResponse(ErrTooLarge) + "\r\n"))
+			connection.Close()
+			return
+		}
+		expr := ParseKDtreeCommand("GET " + record)
+		if !expr.valid || expr.action != "GET" {
+			if invalid == 0 {
+				invalid = line
+			}
+			continue
+		}
+		queries = append(queries, expr.point)
+	}
+	if invalid > 0 {
+		connection.Write([]byte(fmt.Sprintf("INVALID RECORD %d\r\n", invalid)))
+		return
+	}
+	rst, err := store.MultiKNN(queries, k, session.metric)
+	if err != nil {
+		connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+		return
+	}
+	writer := bufio.NewWriter(connection)
+	for i, neighbours := range rst {
+		writer.WriteString(fmt.Sprintf("QUERY %d %s\r\n", i+1, FormatPoint(queries[i])))
+		for _, p := range neighbours {
+			writer.WriteString(FormatNeighbour(queries[i], p, DistanceMetrics[session.metric], nil) + "\r\n")
+		}
+	}
+	writer.WriteString("END\r\n")
+	writer.Flush()
+}
+
+// ExecuteImport reads the document following an IMPORT geojson command, up
+// to a line of its own reading END as EXPORT writes it, and adds its points
+// to the store at once as BULK does. The points follow the dimension and the
+// duplicate policy of the store, and are all rejected if one of them is not
+// accepted. The document is read and dropped in a batch and by a read-only
+// server, without keeping it. A document over MaxImportBytes cannot be told
+// apart from commands without reading it, so the connection is closed
+// instead.
+func ExecuteImport(connection net.Conn, reader *bufio.Reader, store *KdtreeStore, config *ServerConfig, session *Session) {
+	rejection := ""
+	if session.inBatch {
+		rejection = "INVALID IN BATCH"
+	} else if config.ReadOnly {
+		rejection = ErrorResponse(ErrReadOnly)
+	}
+	var document strings.Builder
+	for {
+		line, err := ReadLine(reader, config.MaxLineLength)
+		if err != nil {
+			logger.Debug("cannot read import", "remote", connection.RemoteAddr(), "error", err)
+			connection.Write([]byte("READ ERROR\r\n"))
+			return
+		}
+		if strings.TrimSpace(line) == "END" {
+			break
+		}
+		if rejection != "" {
+			continue
+		}
+		if TooLarge(document.Len()+len(line), config.MaxImportBytes) {
+			connection.Write([]byte(ErrorResponse(ErrTooLarge) + "\r\n"))
+			connection.Close()
+			return
+		}
+		document.WriteString(line)
+	}
+	if rejection != "" {
+		connection.Write([]byte(rejection + "\r\n"))
+		return
+	}
+	pts, skipped, err := ReadGeoJSON([]byte(document.String()))
+	if err == nil {
+		err = store.Bulk(pts)
+	}
+	if err != nil {
+		connection.Write([]byte(ErrorResponse(err) + "\r\n"))
+		return
+	}
+	if skipped > 0 {
+		logger.Info("skipped features that are not points", "remote", connection.RemoteAddr(), "features", skipped)
+	}
+	connection.Write([]byte(fmt.Sprintf("IMPORTED %d\r\n", len(pts))))
+}
+
+func main() {
+	startTime = time.Now()
+	fname := flag.String("config", "config.toml", "-config=<file_name>, - for standard input or an http(s):// URL")
 	flag.Parse()
 	config := ReadConfig(fname)
+	if err := config.Validate(); err != nil {
+		logger.Fatal("invalid config", "file", *fname, "error", err)
+	}
+	level, _ := ParseLogLevel(config.LogLevel)
+	logger.SetLevel(level)
+
+	// Without saved points the tree is created on the first ADD so that its
+	// dimension can be inferred from the first point.
+	var store KdtreeStore
+	CoordinateScale = config.CoordinateScale
+	store.Epsilon = ScaleDistance(config.Epsilon)
+	store.Capacity = config.InitialCapacity
+	store.maxK = config.MaxK
+	store.duplicates = config.DuplicatePolicy
+	store.dedup = NewDedup(time.Duration(config.DedupWindow) * time.Millisecond)
+	MaxDimensions = config.MaxDimensions
+	MaxPayloadBytes = config.MaxPayloadBytes
+	if config.DataFile != "" {
+		pts, err := LoadTree(config.DataFile, config.InitialCapacity)
+		switch {
+		case err == nil:
+			store.Reset(pts)
+			logger.Info("loaded tree", "file", config.DataFile, "points", len(pts))
+		case !os.IsNotExist(err):
+			logger.Fatal("cannot load tree", "file", config.DataFile, "error", err)
+		}
+	}
+	// Seeding the store only while it has no saved points leaves the
+	// points of the seed file to be saved, deleted or cleared like any
+	// other. The write-ahead log is replayed after the seed file is loaded
+	// as it may mutate the seeded points.
+	if config.SeedFile != "" && store.Count() == 0 {
+		pts, skipped, err := LoadCSV(config.SeedFile, config.InitialCapacity)
+		if err != nil {
+			logger.Fatal("cannot load seed file", "file", config.SeedFile, "error", err)
+		}
+		store.Reset(pts)
+		logger.Info("loaded seed file", "file", config.SeedFile, "points", len(pts), "skipped", skipped)
+	}
+	if config.WalFile != "" {
+		applied, err := Replay(&store, config.WalFile)
+		if err != nil {
+			logger.Fatal("cannot replay write-ahead log", "file", config.WalFile, "error", err)
+		}
+		if applied > 0 {
+			logger.Info("replayed write-ahead log", "file", config.WalFile, "commands", applied)
+		}
+		if store.wal, err = OpenWal(config.WalFile); err != nil {
+			logger.Fatal("cannot open write-ahead log", "file", config.WalFile, "error", err)
+		}
+	}
 
-	listener, err := net.Listen("tcp4", config.Host+":"+config.Port)
+	if config.AccessLogFile != "" {
+		var err error
+		if accessLog, err = OpenAccessLog(config.AccessLogFile); err != nil {
+			logger.Fatal("cannot open access log", "file", config.AccessLogFile, "error", err)
+		}
+	}
+
+	listener, err := Listen(&config)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("cannot listen", "network", config.Network, "host", config.Host, "port", config.Port, "error", err)
 	}
 
 	defer listener.Close()
-	fmt.Println("Started kdtreed on HOST:", config.Host, "PORT:", config.Port)
+	fmt.Println("Started", VersionString(), "on HOST:", config.Host, "PORT:", config.Port)
 
-	var store KdtreeStore
-	store.tree = kdtree.New([]kdtree.Point{})
+	if config.DataFile != "" && config.SnapshotInterval > 0 {
+		go Snapshot(&store, config.DataFile, time.Duration(config.SnapshotInterval)*time.Second)
+	}
+
+	if config.MetricsAddr != "" {
+		store.metrics = NewMetrics()
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", MetricsHandler(&store))
+			err := http.ListenAndServe(config.MetricsAddr, mux)
+			logger.Error("metrics server stopped", "addr", config.MetricsAddr, "error", err)
+		}()
+	}
 
+	if config.RestAddr != "" {
+		go func() {
+			err := http.ListenAndServe(config.RestAddr, RestHandler(&store, &config))
+			logger.Error("REST server stopped", "addr", config.RestAddr, "error", err)
+		}()
+	}
+
+	if config.PprofAddr != "" {
+		go func() {
+			err := http.ListenAndServe(config.PprofAddr, PprofHandler())
+			logger.Error("pprof server stopped", "addr", config.PprofAddr, "error", err)
+		}()
+	}
+
+	var conns Connections
+	limiter := NewLimiter(config.RateLimit, config.RateLimitDelay)
+	ApplyTimeouts(&config)
+	namespaces := NewNamespaces(&store)
+
+	shutdown := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("shutting down", "signal", sig)
+		close(shutdown)
+		listener.Close()
+	}()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		// current is the config as last reloaded, which the reloaded
+		// one is compared with.
+		current := config
+		for range hangups {
+			logger.Info("reloading config", "file", *fname)
+			Reload(*fname, &current, limiter)
+			if err := accessLog.Reopen(); err != nil {
+				logger.Error("cannot reopen access log", "file", config.AccessLogFile, "error", err)
+			}
+		}
+	}()
+
+	// Every connection being served holds a slot. In queue mode the accept
+	// loop waits for a free slot before accepting, otherwise connections are
+	// accepted and refused straight away when no slot is free.
+	var slots chan struct{}
+	if config.MaxConnections > 0 {
+		slots = make(chan struct{}, config.MaxConnections)
+	}
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+
+	// delay is how long to wait before accepting again after a temporary
+	// error.
+	var delay time.Duration
 	for {
+		queued := false
+		if slots != nil && config.QueueConnections {
+			select {
+			case slots <- struct{}{}:
+				queued = true
+			case <-shutdown:
+			}
+			if !queued {
+				break
+			}
+		}
+
 		request, err := listener.Accept()
 		if err != nil {
-			log.Println(err)
+			if queued {
+				release()
+			}
+			select {
+			case <-shutdown:
+			default:
+				// Temporary errors, such as running out of file
+				// descriptors, are retried after a growing delay. Any
+				// other error leaves the listener unusable, so the
+				// daemon shuts down rather than spin on it.
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					delay *= 2
+					if delay == 0 {
+						delay = 5 * time.Millisecond
+					}
+					if delay > time.Second {
+						delay = time.Second
+					}
+					logger.Warn("cannot accept connection, retrying", "error", err, "delay", delay)
+					time.Sleep(delay)
+					continue
+				}
+				logger.Error("cannot accept connection, shutting down", "error", err)
+			}
+			break
+		}
+		delay = 0
+		if config.LineEnding == "lf" {
+			request = &LineConn{Conn: request}
+		}
+		if slots != nil && !queued {
+			select {
+			case slots <- struct{}{}:
+			default:
+				TextConn(request, &config).Write([]byte("TOO MANY CONNECTIONS\r\n"))
+				request.Close()
+				continue
+			}
+		}
+		logger.Info("accepted connection", "remote", request.RemoteAddr())
+		if !conns.Add(request) {
+			release()
+			TextConn(request, &config).Write([]byte("SHUTTING DOWN\r\n"))
+			request.Close()
 			continue
 		}
-		go HandleRequest(request, &store)
+		go func() {
+			defer conns.Done(request)
+			defer release()
+			HandleRequest(request, namespaces, &config, limiter)
+		}()
 	}
+
+	conns.Shutdown(&config)
+	logger.Info("stopped kdtreed")
 }
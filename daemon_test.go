@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/etude-ist/kdtreed/protocol"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listen serves every connection to store with config and returns the
+// address to dial.
+func listen(t *testing.T, store *KdtreeStore, config ServerConfig) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	namespaces := NewNamespaces(store)
+	limiter := NewLimiter(0, false)
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go HandleRequest(connection, namespaces, &config, limiter)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dial connects to the server at address and returns the connection, past
+// the banner.
+func dial(t *testing.T, address string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(client)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	return client, reader
+}
+
+// serve starts serving store with config and returns a connection to it.
+func serve(t *testing.T, store *KdtreeStore, config ServerConfig) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	return dial(t, listen(t, store, config))
+}
+
+// exchange sends lines, each ended with CRLF, in a single write and returns
+// the next n response lines, without their line endings.
+func exchange(t *testing.T, client net.Conn, reader *bufio.Reader, n int, lines ...string) []string {
+	t.Helper()
+	if _, err := client.Write([]byte(strings.Join(lines, "\r\n") + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	rst := make([]string, n)
+	for i := range rst {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading response %d to %q: %v", i+1, lines, err)
+		}
+		rst[i] = strings.TrimRight(line, "\r\n")
+	}
+	return rst
+}
+
+// conversation is a sequence of commands, each sent in turn and answered
+// with want.
+type conversation []struct {
+	command string
+	want    []string
+}
+
+// converse plays the conversations of cases, each on a connection of its
+// own to a new, empty store.
+func converse(t *testing.T, cases map[string]conversation) {
+	t.Helper()
+	for name, steps := range cases {
+		t.Run(name, func(t *testing.T) {
+			client, reader := serve(t, &KdtreeStore{}, DefaultConfig())
+			follow(t, client, reader, steps)
+		})
+	}
+}
+
+// follow runs the steps of a conversation on a connection.
+func follow(t *testing.T, client net.Conn, reader *bufio.Reader, steps conversation) {
+	t.Helper()
+	for _, step := range steps {
+		got := exchange(t, client, reader, len(step.want), step.command)
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Errorf("%s: got %q, want %q", step.command, got, step.want)
+		}
+	}
+}
+
+// TestPipelinedCommands sends several commands in one write, which the
+// reader must not lose by buffering past the first.
+func TestPipelinedCommands(t *testing.T) {
+	client, reader := serve(t, &KdtreeStore{}, DefaultConfig())
+	got := exchange(t, client, reader, 3, "ADD {1, 2} 3", "ADD {3, 4} 5", "DEL {3, 4}")
+	want := []string{"{1, 2} added", "{3, 4} added", "{3, 4} deleted"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// examples fills in the placeholders of the syntax of a command with
+// values, so that the syntax of every command seeds a valid command.
+var examples = strings.NewReplacer("{x, y, ...}", "{1, 2}", " data", " 3", " k", " 2", " radius", " 1.5",
+	"[path]", "/tmp/kd.txt", " name", " other", " token", " secret", " n", " 4", "TEXT|JSON", "JSON",
+	"EUCLIDEAN|MANHATTAN|CHEBYSHEV", "MANHATTAN", "[EPS=e]", "EPS=0.5", "[SINCE seconds]", "SINCE 60",
+	"[OFFSET n]", "OFFSET 1", "[LIMIT n]", "LIMIT 2", "[SCORE]", "SCORE", "[WHERE data<op>n]", "WHERE data>1",
+	"[SORT axis]", "SORT 0")
+
+func FuzzParseKDtreeCommand(f *testing.F) {
+	for _, command := range Commands {
+		f.Add(command.Syntax)
+		f.Add(examples.Replace(command.Syntax))
+	}
+	f.Add(`ADD {1e999, 2} 3`)
+	f.Add(`ADD {1, 2} "a \"quoted\" string"`)
+	f.Add(`ADD {-1.5e3, .5} [1, 2.5, -3]`)
+	f.Add(`KNN {1} 9999999999999999999999`)
+	f.Fuzz(func(t *testing.T, command string) {
+		expr := ParseKDtreeCommand(command)
+		if expr.valid {
+			return
+		}
+		expr.Near()
+	})
+}
+
+// TestConcurrentClients has clients adding and deleting points while others
+// query them, for the race detector to catch reads unguarded by the lock.
+func TestConcurrentClients(t *testing.T) {
+	address := listen(t, &KdtreeStore{}, DefaultConfig())
+	var wg sync.WaitGroup
+	failures := make(chan string, 8)
+	for c := 0; c < 8; c++ {
+		client, reader := dial(t, address)
+		writer := c%2 == 0
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				command := fmt.Sprintf("KNN {%d, %d} 3", i%10, c)
+				if i%2 == 1 {
+					command = fmt.Sprintf("RANGE {0, 0} {%d, %d}", i%10, c)
+				}
+				if writer {
+					command = fmt.Sprintf("ADD {%d, %d} %d", i%10, c, i)
+					if i%3 == 0 {
+						command = fmt.Sprintf("DEL {%d, %d}", i%10, c)
+					}
+				}
+				if _, err := client.Write([]byte(command + "\r\n")); err != nil {
+					failures <- err.Error()
+					return
+				}
+				// Queries end with a line of their own, END or EMPTY.
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						failures <- err.Error()
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					if strings.HasPrefix(line, "INVALID") || strings.HasPrefix(line, "DIMENSION") {
+						failures <- command + ": " + line
+						return
+					}
+					if writer || line == "END" || line == "EMPTY" {
+						break
+					}
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(failures)
+	for failure := range failures {
+		t.Error(failure)
+	}
+}
+
+func TestDel(t *testing.T) {
+	converse(t, map[string]conversation{
+		"stored point": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"DEL {1, 2}", []string{"{1, 2} deleted"}},
+			{"COUNT", []string{"COUNT 0"}},
+		},
+		"missing point": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"DEL {2, 1}", []string{"NOT FOUND"}},
+			{"COUNT", []string{"COUNT 1"}},
+		},
+		"deleted twice": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"DEL {1, 2}", []string{"{1, 2} deleted"}},
+			{"DEL {1, 2}", []string{"NOT FOUND"}},
+		},
+	})
+}
+
+func TestActionCase(t *testing.T) {
+	converse(t, map[string]conversation{
+		"upper": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"KNN {1, 2} 1", []string{"{1, 2} data=3 dist=0", "END"}},
+		},
+		"lower": {
+			{"add {1, 2} 3", []string{"{1, 2} added"}},
+			{"knn {1, 2} 1", []string{"{1, 2} data=3 dist=0", "END"}},
+		},
+		"mixed": {
+			{"Add {1, 2} 3", []string{"{1, 2} added"}},
+			{"kNn {1, 2} 1", []string{"{1, 2} data=3 dist=0", "END"}},
+		},
+		"payload kept": {
+			{`add {1, 2} "MiXeD"`, []string{"{1, 2} added"}},
+			{"nearest {1, 2}", []string{`NEAREST {1, 2} "MiXeD"`}},
+		},
+	})
+}
+
+func TestBench(t *testing.T) {
+	converse(t, map[string]conversation{
+		"empty store": {
+			{"BENCH 5", []string{"EMPTY"}},
+		},
+		"over bench_max": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"BENCH 100001", []string{"TOO LARGE"}},
+		},
+	})
+	// The queries of BENCH ask for BenchK neighbours, more than max_k.
+	client, reader := serve(t, &KdtreeStore{maxK: BenchK - 1}, DefaultConfig())
+	follow(t, client, reader, conversation{
+		{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+		{"BENCH 5", []string{"K TOO LARGE"}},
+	})
+}
+
+func TestMakePoint(t *testing.T) {
+	cases := []struct {
+		token string
+		want  []float64
+		valid bool
+	}{
+		{"{1, 2}", []float64{1, 2}, true},
+		{"{-1.5e3, .5, 2.}", []float64{-1500, 0.5, 2}, true},
+		{"{1e308}", []float64{1e308}, true},
+		{"{1e999, 2}", nil, false},
+		{"{-1e400}", nil, false},
+		{"[1, 1e309]", nil, false},
+	}
+	for _, c := range cases {
+		got, err := MakePoint(c.token)
+		if (err == nil) != c.valid || fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("MakePoint(%q) = %v, %v, want %v, valid %v", c.token, got, err, c.want, c.valid)
+		}
+	}
+}
+
+func TestInvalidNumbers(t *testing.T) {
+	converse(t, map[string]conversation{
+		"overflowing coordinate": {
+			{"ADD {1e999, 2} 3", []string{"INVALID POINT"}},
+			{"COUNT", []string{"COUNT 0"}},
+		},
+		"negative overflow": {
+			{"ADD {-1e400, 2} 3", []string{"INVALID POINT"}},
+		},
+		"malformed coordinate": {
+			{"ADD {1..2, 3} 3", []string{"INVALID POINT"}},
+			{"KNN {1, x} 3", []string{"INVALID POINT"}},
+		},
+		"overflowing vector": {
+			{"ADD {1, 2} [1e999]", []string{"INVALID DATA"}},
+		},
+		"overflowing integer": {
+			{"ADD {1, 2} 99999999999999999999", []string{"INVALID DATA"}},
+		},
+		"largest coordinate": {
+			{"ADD {1e308, -2.5e-3} 1", []string{"{1e+308, -0.0025} added"}},
+		},
+	})
+}
+
+func TestRecordsInBatch(t *testing.T) {
+	converse(t, map[string]conversation{
+		"bulk": {
+			{"BEGIN", []string{"OK"}},
+			{"BULK 2\r\n{1, 2} 3\r\n{3, 4} 5", []string{"INVALID IN BATCH"}},
+			{"COMMIT", []string{"COMMITTED 0"}},
+			{"COUNT", []string{"COUNT 0"}},
+		},
+		"swap": {
+			{"BEGIN", []string{"OK"}},
+			{"SWAP 1\r\n{1, 2} 3", []string{"INVALID IN BATCH"}},
+			{"ABORT", []string{"ABORTED 0"}},
+		},
+		"import": {
+			{"BEGIN", []string{"OK"}},
+			{`IMPORT geojson` + "\r\n" + `{"type": "FeatureCollection", "features": []}` + "\r\nEND", []string{"INVALID IN BATCH"}},
+			{"ADD {1, 2} 3", []string{"QUEUED"}},
+			{"COMMIT", []string{"COMMITTED 1"}},
+		},
+	})
+}
+
+func TestKNNUpToK(t *testing.T) {
+	converse(t, map[string]conversation{
+		"no points": {
+			{"KNN {1, 2} 3", []string{"EMPTY"}},
+		},
+		"fewer than k": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"ADD {4, 6} 5", []string{"{4, 6} added"}},
+			{"KNN {1, 2} 3", []string{"{1, 2} data=3 dist=0", "{4, 6} data=5 dist=5", "END"}},
+		},
+		"exactly k": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"ADD {4, 6} 5", []string{"{4, 6} added"}},
+			{"KNN {4, 6} 1", []string{"{4, 6} data=5 dist=0", "END"}},
+		},
+		"all deleted": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"DEL {1, 2}", []string{"{1, 2} deleted"}},
+			{"KNN {1, 2} 3", []string{"EMPTY"}},
+		},
+	})
+}
+
+// grid returns a store of the n×n points of the integer grid.
+func grid(t *testing.T, n int) *KdtreeStore {
+	t.Helper()
+	pts := make([]kdtree.Point, 0, n*n)
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			pts = append(pts, points.NewPoint([]float64{float64(x), float64(y)}, Data{value: x*n + y}))
+		}
+	}
+	store := &KdtreeStore{}
+	if err := store.Bulk(pts); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRangeStreaming(t *testing.T) {
+	store := grid(t, 500)
+	client, reader := serve(t, store, DefaultConfig())
+	first := exchange(t, client, reader, 1, "RANGE {0, 0} {499, 499}")
+	if !strings.HasPrefix(first[0], "{") {
+		t.Fatalf("RANGE answered %q", first[0])
+	}
+	// The client has taken a single point out of megabytes of them, so the
+	// traversal cannot be over, and still holds the read lock.
+	time.Sleep(100 * time.Millisecond)
+	if store.TryLock() {
+		store.Unlock()
+		t.Fatal("the traversal was over before its results were read")
+	}
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading point %d: %v", n+1, err)
+		}
+		if line == "END\r\n" {
+			if n != 500*500 {
+				t.Fatalf("RANGE streamed %d points, want %d", n, 500*500)
+			}
+			break
+		}
+	}
+	if !store.TryLock() {
+		t.Fatal("the read lock is held past the end of the results")
+	}
+	store.Unlock()
+}
+
+func TestRangeWriteTimeout(t *testing.T) {
+	store := grid(t, 500)
+	config := DefaultConfig()
+	config.WriteTimeout = 1
+	client, reader := serve(t, store, config)
+	exchange(t, client, reader, 1, "RANGE {0, 0} {499, 499}")
+	// The client stops reading, which must not hold up writers for longer
+	// than the write timeout.
+	locked := make(chan struct{})
+	go func() {
+		store.Lock()
+		store.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a client that stops reading holds up writers")
+	}
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			break
+		}
+	}
+}
+
+func TestSaveNamespace(t *testing.T) {
+	config := DefaultConfig()
+	config.SnapshotDir = t.TempDir()
+	config.DataFile = filepath.Join(config.SnapshotDir, "data.db")
+	client, reader := serve(t, &KdtreeStore{}, config)
+	path := "other.db"
+	follow(t, client, reader, conversation{
+		{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+		{"SAVE", []string{"SAVED 1"}},
+		{"USE other", []string{"USE other"}},
+		{"SAVE", []string{"NO DATA FILE"}},
+		{"LOAD", []string{"NO DATA FILE"}},
+		{"ADD {4, 5} 6", []string{"{4, 5} added"}},
+		{"ADD {7, 8} 9", []string{"{7, 8} added"}},
+		{"SAVE " + path, []string{"SAVED 2"}},
+		{"MODE JSON", []string{"MODE JSON"}},
+		{`{"op": "save"}`, []string{`{"error":"NO DATA FILE","ok":false}`}},
+		{`{"op": "load"}`, []string{`{"error":"NO DATA FILE","ok":false}`}},
+	})
+	client, reader = serve(t, &KdtreeStore{}, config)
+	follow(t, client, reader, conversation{
+		{"LOAD", []string{"LOADED 1"}},
+		{"LOAD " + path, []string{"LOADED 2"}},
+	})
+}
+
+func TestLoadDrained(t *testing.T) {
+	config := DefaultConfig()
+	config.SnapshotDir = t.TempDir()
+	client, reader := serve(t, &KdtreeStore{}, config)
+	path := "data.db"
+	follow(t, client, reader, conversation{
+		{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+		{"SAVE " + path, []string{"SAVED 1"}},
+		{"DRAIN", []string{"DRAINED 1"}},
+		{"LOAD " + path, []string{"READ ONLY"}},
+		{"MODE JSON", []string{"MODE JSON"}},
+		{`{"op": "load", "path": "` + path + `"}`, []string{`{"error":"READ ONLY","ok":false}`}},
+		{`{"op": "load", "path": "` + path + `.missing"}`, []string{`{"error":"LOAD FAILED","ok":false}`}},
+	})
+}
+
+// TestExportFailure exports a point GeoJSON cannot encode, which must end
+// the document with an error rather than leave the client waiting for END.
+func TestExportFailure(t *testing.T) {
+	store := &KdtreeStore{}
+	store.Add([]float64{math.Inf(1), 0}, Data{value: 1})
+	client, reader := serve(t, store, DefaultConfig())
+	got := exchange(t, client, reader, 2, "EXPORT geojson")
+	if got[1] != "ERROR" {
+		t.Errorf("EXPORT answered %q, want the document cut short by ERROR", got)
+	}
+}
+
+func TestTrailingGarbage(t *testing.T) {
+	converse(t, map[string]conversation{
+		"action": {
+			{"COUNT points", []string{"TRAILING GARBAGE"}},
+			{"PING pong", []string{"TRAILING GARBAGE"}},
+			{"CLEAR all", []string{"TRAILING GARBAGE"}},
+			{"COUNT   ", []string{"COUNT 0"}},
+		},
+		"point": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"ADD {1, 2} 3 4", []string{"TRAILING GARBAGE"}},
+			{"DEL {1, 2} now", []string{"TRAILING GARBAGE"}},
+			{"GET {1, 2} {3, 4}", []string{"TRAILING GARBAGE"}},
+			{"NEAREST {1, 2} 1", []string{"TRAILING GARBAGE"}},
+			{"COUNT", []string{"COUNT 1"}},
+		},
+		"query": {
+			{"KNN {1, 2} 3 junk", []string{"TRAILING GARBAGE"}},
+			{"RANGE {0, 0} {1, 1} {2, 2}", []string{"TRAILING GARBAGE"}},
+			{"BALL {1, 2} 3 4", []string{"TRAILING GARBAGE"}},
+			{"CENTROID {0, 0} {1, 1} x", []string{"TRAILING GARBAGE"}},
+		},
+		"argument": {
+			{"USE other namespace", []string{"TRAILING GARBAGE"}},
+			{"METRIC EUCLIDEAN MANHATTAN", []string{"TRAILING GARBAGE"}},
+			{"EXPORT geojson pretty", []string{"TRAILING GARBAGE"}},
+			{"BENCH 5 6", []string{"TRAILING GARBAGE"}},
+		},
+		"batch": {
+			{"BEGIN now", []string{"TRAILING GARBAGE"}},
+			{"BULK 1 2", []string{"TRAILING GARBAGE"}},
+			{"COUNT", []string{"COUNT 0"}},
+		},
+	})
+	// Every command of the protocol, with all its options, rejects a word
+	// after its last argument.
+	steps := conversation{}
+	for _, command := range Commands {
+		steps = append(steps, struct {
+			command string
+			want    []string
+		}{examples.Replace(command.Syntax) + " junk", []string{"TRAILING GARBAGE"}})
+	}
+	client, reader := serve(t, &KdtreeStore{}, DefaultConfig())
+	follow(t, client, reader, append(steps, conversation{{"COUNT", []string{"COUNT 0"}}}...))
+}
+
+// TestStatusCodes checks the codes of the status_codes option, DEDUPED
+// among them, which is a failure as DUPLICATE is.
+func TestStatusCodes(t *testing.T) {
+	store := &KdtreeStore{}
+	store.dedup = NewDedup(time.Minute)
+	config := DefaultConfig()
+	config.StatusCodes = true
+	client, reader := serve(t, store, config)
+	follow(t, client, reader, conversation{
+		{"ADD {1, 2} 3", []string{"200 {1, 2} added"}},
+		{"ADD {1, 2} 3", []string{"409 DEDUPED"}},
+		{"GET {3, 4}", []string{"404 NOT FOUND"}},
+		{"COUNT junk", []string{"400 TRAILING GARBAGE"}},
+		{"RANGE {0, 0} {5, 5}", []string{"200 {1, 2} 3", "200 END"}},
+	})
+	if !protocol.IsError("DEDUPED") {
+		t.Error("DEDUPED is not an error for clients")
+	}
+}
+
+// TestEmptyTree runs every query on trees without points: new, cleared and
+// emptied by DEL, which leaves the tree with a root and no points, through
+// the search of the tree and, with a query timeout, that of the store.
+func TestEmptyTree(t *testing.T) {
+	queries := conversation{
+		{"DEL {1, 2}", []string{"NOT FOUND"}},
+		{"GET {1, 2}", []string{"NOT FOUND"}},
+		{"KNN {1, 2} 3", []string{"EMPTY"}},
+		{"KNN {1, 2} 3 EPS=0.5", []string{"EMPTY"}},
+		{"FKNN {1, 2} 3", []string{"EMPTY"}},
+		{"NEAREST {1, 2}", []string{"EMPTY"}},
+		{"RANGE {0, 0} {5, 5}", []string{"END"}},
+		{"CENTROID {0, 0} {5, 5}", []string{"EMPTY"}},
+		{"COUNT", []string{"COUNT 0"}},
+	}
+	emptied := map[string]conversation{
+		"new": nil,
+		"cleared": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"CLEAR", []string{"CLEARED"}},
+		},
+		"deleted": {
+			{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+			{"ADD {3, 4} 5", []string{"{3, 4} added"}},
+			{"DEL {1, 2}", []string{"{1, 2} deleted"}},
+			{"DEL {3, 4}", []string{"{3, 4} deleted"}},
+		},
+	}
+	keepTimeouts(t)
+	for _, timeout := range []int{0, 1000} {
+		ApplyTimeouts(&ServerConfig{QueryTimeout: timeout})
+		cases := map[string]conversation{}
+		for name, steps := range emptied {
+			cases[fmt.Sprintf("%s, query_timeout %d", name, timeout)] = append(append(conversation{}, steps...), queries...)
+		}
+		converse(t, cases)
+	}
+}
+
+// TestSnapshotPath checks that clients can only SAVE and LOAD the files of
+// the snapshot directory.
+func TestSnapshotPath(t *testing.T) {
+	config := DefaultConfig()
+	config.SnapshotDir = t.TempDir()
+	client, reader := serve(t, &KdtreeStore{}, config)
+	follow(t, client, reader, conversation{
+		{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+		{"SAVE points.db", []string{"SAVED 1"}},
+		{"LOAD points.db", []string{"LOADED 1"}},
+		{"SAVE " + filepath.Join(config.SnapshotDir, "points.db"), []string{"INVALID PATH"}},
+		{"LOAD ../points.db", []string{"INVALID PATH"}},
+		{"SAVE saved/../../points.db", []string{"INVALID PATH"}},
+	})
+	if _, err := os.Stat(filepath.Join(config.SnapshotDir, "points.db")); err != nil {
+		t.Errorf("SAVE points.db did not write to the snapshot directory: %v", err)
+	}
+	converse(t, map[string]conversation{
+		"no snapshot dir": {
+			{"SAVE points.db", []string{"NO SNAPSHOT DIR"}},
+			{"LOAD points.db", []string{"NO SNAPSHOT DIR"}},
+		},
+	})
+}
+
+func TestMultiKNNLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.MknnMax = 2
+	client, reader := serve(t, &KdtreeStore{}, config)
+	follow(t, client, reader, conversation{
+		{"ADD {1, 2} 3", []string{"{1, 2} added"}},
+		{"MKNN 1\r\n{1, 2}\r\n{4, 6}\r\nEND", []string{"QUERY 1 {1, 2}", "{1, 2} data=3 dist=0", "QUERY 2 {4, 6}", "{1, 2} data=3 dist=5", "END"}},
+		{"MKNN 1\r\n{1, 2}\r\n{4, 6}\r\n{7, 8}\r\nEND", []string{"TOO LARGE"}},
+	})
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("the connection is still open after TOO LARGE, and answered %q", line)
+	}
+}
+
+func TestImportLimit(t *testing.T) {
+	document := `{"type": "FeatureCollection", "features": [` + "\r\n" +
+		`{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 2]}, "properties": {"data": 3}}` + "\r\n]}\r\nEND"
+	config := DefaultConfig()
+	config.ReadOnly = true
+	client, reader := serve(t, &KdtreeStore{}, config)
+	follow(t, client, reader, conversation{
+		{"IMPORT geojson\r\n" + document, []string{"READ ONLY"}},
+		{"COUNT", []string{"COUNT 0"}},
+	})
+	config = DefaultConfig()
+	config.MaxImportBytes = 64
+	client, reader = serve(t, &KdtreeStore{}, config)
+	follow(t, client, reader, conversation{
+		{"IMPORT geojson\r\n" + document, []string{"TOO LARGE"}},
+	})
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("the connection is still open after TOO LARGE, and answered %q", line)
+	}
+}
+
+// TestGeoJSONRoundTrip imports what EXPORT writes, integer payloads too
+// large for 32 bits among them.
+func TestGeoJSONRoundTrip(t *testing.T) {
+	client, reader := serve(t, &KdtreeStore{}, DefaultConfig())
+	follow(t, client, reader, conversation{
+		{"ADD {1, 2} 9007199254740993", []string{"{1, 2} added"}},
+		{`ADD {3, 4} "text"`, []string{"{3, 4} added"}},
+		{"ADD {5, 6} [1.5, 2]", []string{"{5, 6} added"}},
+	})
+	document := exchange(t, client, reader, 6, "EXPORT geojson")
+	if document[5] != "END" {
+		t.Fatalf("EXPORT answered %q", document)
+	}
+	client, reader = serve(t, &KdtreeStore{}, DefaultConfig())
+	follow(t, client, reader, conversation{
+		{"IMPORT geojson\r\n" + strings.Join(document, "\r\n"), []string{"IMPORTED 3"}},
+		{"GET {1, 2}", []string{"GET {1, 2} 9007199254740993"}},
+		{"GET {3, 4}", []string{`GET {3, 4} "text"`}},
+		{"GET {5, 6}", []string{"GET {5, 6} [1.5, 2]"}},
+	})
+}
+
+func TestRangeSort(t *testing.T) {
+	converse(t, map[string]conversation{
+		"sorted": {
+			{"ADD {3, 1} 1", []string{"{3, 1} added"}},
+			{"ADD {1, 2} 2", []string{"{1, 2} added"}},
+			{"RANGE {0, 0} {5, 5} SORT 0", []string{"{1, 2} 2", "{3, 1} 1", "END"}},
+			{"RANGE {0, 0} {5, 5} SORT 1", []string{"{3, 1} 1", "{1, 2} 2", "END"}},
+		},
+		"axis out of range": {
+			{"ADD {3, 1} 1", []string{"{3, 1} added"}},
+			{"RANGE {0, 0} {5, 5} SORT 2", []string{"INVALID AXIS"}},
+		},
+		"empty tree": {
+			{"RANGE {0, 0} {5, 5} SORT 2", []string{"END"}},
+		},
+	})
+}
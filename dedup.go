@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// Dedup remembers the coordinates recently added by ADD, for those sent
+// again within DedupWindow to be dropped. It is guarded by the lock of the
+// store it belongs to.
+type Dedup struct {
+	window time.Duration
+	recent map[string]time.Time
+	// pruned is when the entries older than the window were last
+	// forgotten.
+	pruned time.Time
+}
+
+// NewDedup returns a Dedup over window, or nil, which drops nothing, if
+// window is 0.
+func NewDedup(window time.Duration) *Dedup {
+	if window <= 0 {
+		return nil
+	}
+	return &Dedup{window: window, recent: make(map[string]time.Time)}
+}
+
+// Seen reports whether the exact coordinates of point were added within the
+// window before now.
+func (dedup *Dedup) Seen(point []float64, now time.Time) bool {
+	if dedup == nil {
+		return false
+	}
+	added, ok := dedup.recent[FormatPoint(point)]
+	return ok && now.Sub(added) < dedup.window
+}
+
+// Add records that point was added at now. The entries older than the
+// window are forgotten at most once per window, so that the map only holds
+// about a window's worth of inserts.
+func (dedup *Dedup) Add(point []float64, now time.Time) {
+	if dedup == nil {
+		return
+	}
+	dedup.recent[FormatPoint(point)] = now
+	if now.Sub(dedup.pruned) < dedup.window {
+		return
+	}
+	for key, added := range dedup.recent {
+		if now.Sub(added) >= dedup.window {
+			delete(dedup.recent, key)
+		}
+	}
+	dedup.pruned = now
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math"
+	"sort"
+)
+
+type farCandidate struct {
+	point    kdtree.Point
+	distance float64
+}
+
+// farthest is a min-heap of the farthest points found so far, the nearest
+// of them on top, so that it is the one to replace when a farther point is
+// found.
+type farthest []farCandidate
+
+func (h farthest) Len() int            { return len(h) }
+func (h farthest) Less(i, j int) bool  { return h[i].distance < h[j].distance }
+func (h farthest) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *farthest) Push(x interface{}) { *h = append(*h, x.(farCandidate)) }
+func (h *farthest) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// FarthestKNN returns up to k points farthest from point under the named
+// metric, farthest first. The tree only prunes towards the nearest points,
+// so every point is visited once and kept on a heap of the k farthest so
+// far, which costs O(n log k) for n points, against the O(log n) of
+// descending the tree for KNN.
+func (store *KdtreeStore) FarthestKNN(point []float64, k int, metric string) ([]kdtree.Point, error) {
+	if store.maxK > 0 && k > store.maxK {
+		return nil, ErrKTooLarge
+	}
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(point); err != nil {
+		return nil, err
+	}
+	// The walk spans all of space, as any point may be among the farthest.
+	lower := make([]float64, len(point))
+	upper := make([]float64, len(point))
+	for i := range point {
+		lower[i], upper[i] = math.Inf(-1), math.Inf(1)
+	}
+	ctx, cancel := store.queryContext()
+	defer cancel()
+	distance := DistanceMetrics[metric]
+	found := farthest{}
+	err := store.WalkContext(ctx, lower, upper, func(p kdtree.Point) bool {
+		d := distance(point, p.(*points.Point).Coordinates)
+		if len(found) < k {
+			heap.Push(&found, farCandidate{p, d})
+		} else if d > found[0].distance {
+			found[0] = farCandidate{p, d}
+			heap.Fix(&found, 0)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].distance > found[j].distance })
+	rst := make([]kdtree.Point, len(found))
+	for i, c := range found {
+		rst[i] = c.point
+	}
+	return rst, nil
+}
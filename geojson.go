@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"time"
+)
+
+// ErrInvalidGeoJSON is returned for a document that is not a GeoJSON
+// FeatureCollection, or has a feature that cannot be stored.
+var ErrInvalidGeoJSON = errors.New("invalid GeoJSON")
+
+// GeoJSONFeature is a stored point as a GeoJSON Point feature, e.g.
+//
+//	{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{"data":3}}
+//
+// The payload is the data property, as in JSON mode, and the time the point
+// was added, if known, the added property.
+type GeoJSONFeature struct {
+	Type       string                     `json:"type"`
+	Geometry   GeoJSONGeometry            `json:"geometry"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+type GeoJSONGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// MakeGeoJSONFeature returns the feature of a stored point.
+func MakeGeoJSONFeature(p kdtree.Point) GeoJSONFeature {
+	point := p.(*points.Point)
+	data := point.Data.(Data)
+	properties := map[string]json.RawMessage{}
+	properties["data"], _ = json.Marshal(data)
+	if !data.added.IsZero() {
+		properties["added"], _ = json.Marshal(data.added.UTC().Format(time.RFC3339Nano))
+	}
+	return GeoJSONFeature{Type: "Feature", Geometry: GeoJSONGeometry{Type: "Point", Coordinates: Unscale(point.Coordinates)}, Properties: properties}
+}
+
+// WriteGeoJSON writes pts as a GeoJSON FeatureCollection, one feature per
+// line so that large trees are written as they are encoded. The points must
+// be 2D, as GeoJSON positions are longitude and latitude.
+func WriteGeoJSON(writer *bufio.Writer, pts []kdtree.Point) error {
+	writer.WriteString(`{"type":"FeatureCollection","features":[` + "\r\n")
+	for i, p := range pts {
+		feature, err := json.Marshal(MakeGeoJSONFeature(p))
+		if err != nil {
+			return err
+		}
+		writer.Write(feature)
+		if i < len(pts)-1 {
+			writer.WriteString(",")
+		}
+		writer.WriteString("\r\n")
+	}
+	writer.WriteString("]}\r\n")
+	return writer.Flush()
+}
+
+// ReadGeoJSON returns the points of the Point features of a GeoJSON
+// FeatureCollection and the number of other features, which are skipped.
+// The payload of a point is its data property, as written by WriteGeoJSON,
+// or else its properties as a JSON string, or 0 if it has none. Points and
+// payloads are bounded by MaxDimensions and MaxPayloadBytes as they are in
+// commands.
+func ReadGeoJSON(document []byte) ([]kdtree.Point, int, error) {
+	var collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry *struct {
+				Type string `json:"type"`
+				// Coordinates are only decoded for Points, as
+				// the other geometries nest them deeper.
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(document, &collection); err != nil || collection.Type != "FeatureCollection" {
+		return nil, 0, ErrInvalidGeoJSON
+	}
+	pts := []kdtree.Point{}
+	skipped := 0
+	for _, feature := range collection.Features {
+		if feature.Geometry == nil || feature.Geometry.Type != "Point" {
+			skipped++
+			continue
+		}
+		var point []float64
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &point); err != nil || len(point) == 0 {
+			return nil, 0, ErrInvalidGeoJSON
+		}
+		if TooLarge(len(point), MaxDimensions) {
+			return nil, 0, ErrTooLarge
+		}
+		data, err := MakeGeoJSONData(feature.Properties)
+		if err != nil {
+			return nil, 0, err
+		}
+		pts = append(pts, points.NewPoint(Scale(point), data))
+	}
+	return pts, skipped, nil
+}
+
+// MakeGeoJSONData returns the payload of a feature with the given
+// properties.
+func MakeGeoJSONData(properties map[string]json.RawMessage) (Data, error) {
+	var data Data
+	if raw, ok := properties["data"]; ok {
+		if TooLarge(len(raw), MaxPayloadBytes) {
+			return data, ErrTooLarge
+		}
+		if data, ok = MakeJSONData(raw); !ok {
+			return data, ErrInvalidGeoJSON
+		}
+	} else if len(properties) > 0 {
+		encoded, _ := json.Marshal(properties)
+		if TooLarge(len(encoded), MaxPayloadBytes) {
+			return data, ErrTooLarge
+		}
+		data = Data{str: string(encoded), quoted: true}
+	}
+	if raw, ok := properties["added"]; ok {
+		var added string
+		if json.Unmarshal(raw, &added) != nil {
+			return data, ErrInvalidGeoJSON
+		}
+		var err error
+		if data.added, err = time.Parse(time.RFC3339Nano, added); err != nil {
+			return data, ErrInvalidGeoJSON
+		}
+	}
+	return data, nil
+}
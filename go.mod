@@ -1,8 +1,10 @@
 module github.com/etude-ist/kdtreed
 
-go 1.14
+go 1.18
 
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/kyroy/kdtree v0.0.0-20200419114247-70830f883f1d
 )
+
+require github.com/kyroy/priority-queue v0.0.0-20180327160706-6e21825e7e0c // indirect
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandHelp describes a command of the text protocol.
+type CommandHelp struct {
+	Action  string
+	Syntax  string
+	Summary string
+}
+
+// Commands lists the commands of the text protocol in the order HELP shows
+// them. It is also where IsAction takes the actions from, so that no action
+// goes without help. An action must come after any action it is a prefix
+// of, e.g. DELRANGE before DEL, for the longer one to be matched at all.
+var Commands = []CommandHelp{
+	{"ADD", "ADD {x, y, ...} data", "insert a point with an integer, \"string\" or [vector] payload"},
+	{"UPDATE", "UPDATE {x, y, ...} data", "replace the payload of a point"},
+	{"DELRANGE", "DELRANGE {x, y, ...} {x, y, ...}", "delete every point in the box between two corners"},
+	{"DEL", "DEL {x, y, ...}", "delete a point"},
+	{"GET", "GET {x, y, ...}", "return a point with its payload"},
+	{"KNN", "KNN {x, y, ...} k [EPS=e] [WHERE data<op>n] [SINCE seconds] [OFFSET n] [LIMIT n] [SCORE]", "list the k nearest points, within 1+e of the true distance, op being <, > or ="},
+	{"MKNN", "MKNN k", "list the k nearest neighbours of each point on the following lines, up to END"},
+	{"FKNN", "FKNN {x, y, ...} k", "list the k farthest points, farthest first, visiting every point"},
+	{"KDIST", "KDIST {x, y, ...} k", "return the distance to the k-th nearest point"},
+	{"RANGE", "RANGE {x, y, ...} {x, y, ...} [SINCE seconds] [SORT axis]", "list the points in the box between two corners, ordered by coordinate axis (from 0)"},
+	{"BALL", "BALL {x, y, ...} radius", "list the points within radius of a point"},
+	{"NEAREST", "NEAREST {x, y, ...}", "return the nearest point"},
+	{"CENTROID", "CENTROID {x, y, ...} {x, y, ...}", "return the mean of the points in the box between two corners and their number"},
+	{"BOUNDS", "BOUNDS", "return the corners of the bounding box of the points"},
+	{"COUNTBALL", "COUNTBALL {x, y, ...} radius", "return the number of points within radius of a point"},
+	{"COUNT", "COUNT", "return the number of points"},
+	{"CLEAR", "CLEAR", "delete every point"},
+	{"SAVE", "SAVE [path]", "write the points to path in the snapshot directory, or to the data file in the default namespace"},
+	{"LOAD", "LOAD [path]", "replace the points with those of path in the snapshot directory, or of the data file in the default namespace"},
+	{"PING", "PING", "check that the server is alive"},
+	{"STATS", "STATS", "report the points, dimension, uptime and commands served"},
+	{"DEPTH", "DEPTH", "report the depth of the tree against that of a balanced one"},
+	{"MODE", "MODE TEXT|JSON", "switch the protocol of the connection"},
+	{"METRIC", "METRIC EUCLIDEAN|MANHATTAN|CHEBYSHEV", "select the distance metric of the connection"},
+	{"USE", "USE name", "switch the connection to the tree of a namespace, creating it"},
+	{"AUTH", "AUTH token", "authenticate the connection"},
+	{"BULK", "BULK n", "add the n {x, y, ...} data records on the following lines"},
+	{"SWAP", "SWAP n", "replace every point with the n records on the following lines at once"},
+	{"DRAIN", "DRAIN", "make the store read-only and save it to the data file before shutdown"},
+	{"REBALANCE", "REBALANCE", "rebuild the tree balanced"},
+	{"BENCH", "BENCH n [EPS=e]", "time n random KNN queries"},
+	{"DUMP", "DUMP", "list every point"},
+	{"EXPORT", "EXPORT geojson", "write every 2D point as a feature of a GeoJSON FeatureCollection, then END"},
+	{"IMPORT", "IMPORT geojson", "add the Point features of the GeoJSON FeatureCollection sent next, up to END"},
+	{"BEGIN", "BEGIN", "start queueing ADD, UPDATE, DEL and CLEAR commands"},
+	{"COMMIT", "COMMIT", "apply the queued commands at once"},
+	{"ABORT", "ABORT", "discard the queued commands"},
+	{"VERSION", "VERSION", "report the version and commit of the build"},
+	{"HELP", "HELP", "list the commands"},
+	{"END", "END", "close the connection"},
+}
+
+// ActionPattern matches the action of any of the Commands.
+var ActionPattern = actionPattern()
+
+func actionPattern() string {
+	actions := make([]string, len(Commands))
+	for i, command := range Commands {
+		actions[i] = command.Action
+	}
+	return "(?i)" + strings.Join(actions, "|")
+}
+
+// Help returns the response lines of HELP, one per command with its syntax
+// aligned in a column.
+func Help() []string {
+	width := 0
+	for _, command := range Commands {
+		if len(command.Syntax) > width {
+			width = len(command.Syntax)
+		}
+	}
+	lines := make([]string, len(Commands))
+	for i, command := range Commands {
+		lines[i] = fmt.Sprintf("%-*s  %s", width, command.Syntax, command.Summary)
+	}
+	return lines
+}
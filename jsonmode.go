@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// JSONRequest is one command of the JSON mode, e.g.
+//
+//	{"op":"add","point":[1,2],"data":3}
+//	{"op":"knn","point":[1,2],"k":5}
+//	{"op":"range","point":[0,0],"bound":[10,10]}
+//	{"op":"ball","point":[1,2],"radius":1.5}
+//
+// Ops are the lower-case actions of the text protocol.
+type JSONRequest struct {
+	Op     string          `json:"op"`
+	Point  []float64       `json:"point"`
+	Bound  []float64       `json:"bound"`
+	Radius float64         `json:"radius"`
+	K      int             `json:"k"`
+	Eps    float64         `json:"eps"`
+	Data   json.RawMessage `json:"data"`
+	Mode   string          `json:"mode"`
+	Token  string          `json:"token"`
+	Metric string          `json:"metric"`
+	Path   string          `json:"path"`
+}
+
+// JSONPoint is a stored point as returned in JSON responses.
+type JSONPoint struct {
+	Point []float64   `json:"point"`
+	Data  interface{} `json:"data"`
+}
+
+// JSONResponse is the reply to a JSONRequest. Failed requests have ok set to
+// false and error set to the response of the text protocol.
+type JSONResponse map[string]interface{}
+
+// MarshalJSON encodes the payload as a JSON number, string or array.
+func (data Data) MarshalJSON() ([]byte, error) {
+	if data.quoted {
+		return json.Marshal(data.str)
+	}
+	if data.vector != nil {
+		return json.Marshal(data.vector)
+	}
+	return json.Marshal(data.value)
+}
+
+// MakeJSONData decodes a payload given as an integer, a string or an array
+// of numbers. Integers are those of the text protocol, from 0 to the largest
+// int, decoded exactly; written with a fraction or an exponent, such as 3.0,
+// they are only accepted up to 2^53, past which a float64 cannot hold every
+// integer.
+func MakeJSONData(raw json.RawMessage) (Data, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return Data{}, false
+	}
+	switch value := value.(type) {
+	case string:
+		return Data{str: value, quoted: true}, true
+	case json.Number:
+		if integer, err := strconv.Atoi(value.String()); err == nil && integer >= 0 {
+			return Data{value: integer}, true
+		}
+		number, err := value.Float64()
+		if err != nil || number != math.Trunc(number) || number < 0 || number > 1<<53 {
+			return Data{}, false
+		}
+		return Data{value: int(number)}, true
+	case []interface{}:
+		vector := make([]float64, len(value))
+		for i, x := range value {
+			number, ok := x.(json.Number)
+			if !ok {
+				return Data{}, false
+			}
+			var err error
+			if vector[i], err = number.Float64(); err != nil {
+				return Data{}, false
+			}
+		}
+		return Data{vector: vector}, true
+	}
+	return Data{}, false
+}
+
+func MakeJSONPoints(pts []kdtree.Point) []JSONPoint {
+	rst := make([]JSONPoint, len(pts))
+	for i, p := range pts {
+		point := p.(*points.Point)
+		rst[i] = JSONPoint{Point: Unscale(point.Coordinates), Data: point.Data}
+	}
+	return rst
+}
+
+func JSONError(err string) JSONResponse {
+	return JSONResponse{"ok": false, "error": err}
+}
+
+func JSONResult(err error, kv ...interface{}) JSONResponse {
+	if err != nil {
+		return JSONError(ErrorResponse(err))
+	}
+	response := JSONResponse{"ok": true}
+	for i := 0; i+1 < len(kv); i += 2 {
+		response[kv[i].(string)] = kv[i+1]
+	}
+	return response
+}
+
+// RequestPoint returns the point of a JSON request, as stored, or nil if it
+// has none or is not valid JSON.
+func RequestPoint(line string) []float64 {
+	var request JSONRequest
+	if err := json.Unmarshal([]byte(line), &request); err != nil {
+		return nil
+	}
+	return Scale(request.Point)
+}
+
+// ExecuteJSON runs one JSON command against the store through the same
+// operations as ExecuteCommand. It returns the response to send and the op
+// that was run, which is "end" when the client asked to disconnect and
+// "mode" when it switched the session back to the text protocol.
+func ExecuteJSON(line string, store *KdtreeStore, config *ServerConfig, session *Session) (JSONResponse, string) {
+	var request JSONRequest
+	if err := json.Unmarshal([]byte(line), &request); err != nil {
+		return JSONError("INVALID COMMAND"), ""
+	}
+	op := strings.ToLower(request.Op)
+	needsPoint := op == "add" || op == "update" || op == "del" || op == "get" || op == "knn" || op == "fknn" || op == "kdist" || op == "nearest" || op == "range" || op == "delrange" || op == "centroid" || op == "ball" || op == "countball"
+	if !session.Allows(strings.ToUpper(op)) {
+		return JSONError("UNAUTHORIZED"), op
+	}
+	if config.ReadOnly && Mutations[strings.ToUpper(op)] {
+		return JSONResult(ErrReadOnly), op
+	}
+	if needsPoint && len(request.Point) == 0 {
+		return JSONError("INVALID POINT"), op
+	}
+	if TooLarge(len(request.Point), MaxDimensions) || TooLarge(len(request.Bound), MaxDimensions) || TooLarge(len(request.Data), MaxPayloadBytes) {
+		return JSONError("TOO LARGE"), op
+	}
+	request.Point, request.Bound, request.Radius = Scale(request.Point), Scale(request.Bound), ScaleDistance(request.Radius)
+
+	switch op {
+	case "ping":
+		return JSONResult(nil), op
+	case "end":
+		return JSONResult(nil), op
+	case "mode":
+		if !strings.EqualFold(request.Mode, "text") {
+			return JSONError("INVALID MODE"), ""
+		}
+		session.jsonMode = false
+		return JSONResult(nil, "mode", "text"), op
+	case "metric":
+		metric := strings.ToUpper(request.Metric)
+		if DistanceMetrics[metric] == nil {
+			return JSONError("INVALID METRIC"), op
+		}
+		session.metric = metric
+		return JSONResult(nil, "metric", strings.ToLower(metric)), op
+	case "auth":
+		if !session.Authenticate(config, request.Token) {
+			logger.Warn("authentication failed")
+			return JSONError("UNAUTHORIZED"), op
+		}
+		return JSONResult(nil), op
+	case "add":
+		data, ok := MakeJSONData(request.Data)
+		if !ok {
+			return JSONError("INVALID DATA"), op
+		}
+		return JSONResult(store.Add(request.Point, data)), op
+	case "update":
+		data, ok := MakeJSONData(request.Data)
+		if !ok {
+			return JSONError("INVALID DATA"), op
+		}
+		return JSONResult(store.Update(request.Point, data)), op
+	case "del":
+		return JSONResult(store.Delete(request.Point)), op
+	case "knn":
+		if request.K <= 0 {
+			return JSONError("INVALID COUNT"), op
+		}
+		if request.Eps < 0 {
+			return JSONError("INVALID EPS"), op
+		}
+		rst, err := store.ApproximateKNN(request.Point, request.K, session.metric, request.Eps)
+		return JSONResult(err, "points", MakeJSONPoints(rst)), op
+	case "fknn":
+		if request.K <= 0 {
+			return JSONError("INVALID COUNT"), op
+		}
+		rst, err := store.FarthestKNN(request.Point, request.K, session.metric)
+		return JSONResult(err, "points", MakeJSONPoints(rst)), op
+	case "get":
+		p, err := store.Get(request.Point)
+		if err != nil {
+			return JSONResult(err), op
+		}
+		return JSONResult(nil, "point", MakeJSONPoints([]kdtree.Point{p})[0]), op
+	case "kdist":
+		if request.K <= 0 {
+			return JSONError("INVALID COUNT"), op
+		}
+		distance, ok, err := store.KDist(request.Point, request.K, session.metric)
+		if err == nil && !ok {
+			return JSONError("EMPTY"), op
+		}
+		return JSONResult(err, "distance", distance), op
+	case "nearest":
+		rst, err := store.KNN(request.Point, 1, session.metric)
+		if err != nil {
+			return JSONResult(err), op
+		}
+		if len(rst) == 0 {
+			return JSONError("EMPTY"), op
+		}
+		return JSONResult(nil, "point", MakeJSONPoints(rst)[0]), op
+	case "range":
+		if len(request.Bound) == 0 {
+			return JSONError("INVALID POINT"), op
+		}
+		rst, err := store.Range(request.Point, request.Bound)
+		return JSONResult(err, "points", MakeJSONPoints(rst)), op
+	case "centroid":
+		if len(request.Bound) == 0 {
+			return JSONError("INVALID POINT"), op
+		}
+		centroid, count, err := store.Centroid(request.Point, request.Bound)
+		if err == nil && count == 0 {
+			return JSONError("EMPTY"), op
+		}
+		return JSONResult(err, "point", Unscale(centroid), "count", count), op
+	case "delrange":
+		if len(request.Bound) == 0 {
+			return JSONError("INVALID POINT"), op
+		}
+		count, err := store.DeleteRange(request.Point, request.Bound)
+		return JSONResult(err, "count", count), op
+	case "ball":
+		if request.Radius < 0 {
+			return JSONError("INVALID RADIUS"), op
+		}
+		rst, err := store.Ball(request.Point, request.Radius, session.metric)
+		return JSONResult(err, "points", MakeJSONPoints(rst)), op
+	case "bounds":
+		lower, upper, ok := store.Bounds()
+		if !ok {
+			return JSONError("EMPTY"), op
+		}
+		return JSONResult(nil, "lower", Unscale(lower), "upper", Unscale(upper)), op
+	case "countball":
+		if request.Radius < 0 {
+			return JSONError("INVALID RADIUS"), op
+		}
+		count, err := store.CountBall(request.Point, request.Radius, session.metric)
+		return JSONResult(err, "count", count), op
+	case "count":
+		count, _ := store.Stats()
+		return JSONResult(nil, "count", count), op
+	case "version":
+		return JSONResult(nil, "version", Version, "commit", Commit), op
+	case "stats":
+		count, dimension := store.Stats()
+		return JSONResult(nil, "points", count, "dimension", dimension,
+			"uptime", int(time.Since(startTime).Seconds()), "commands", atomic.LoadUint64(&store.commands)), op
+	case "clear":
+		return JSONResult(store.Clear()), op
+	case "rebalance":
+		return JSONResult(nil, "count", store.Rebalance()), op
+	case "save":
+		fname, checkpoint, err := session.SnapshotFile(config, request.Path)
+		if err != nil {
+			return JSONResult(err), op
+		}
+		if fname == "" {
+			return JSONError("NO DATA FILE"), op
+		}
+		count, err := store.Save(fname, checkpoint)
+		if err != nil {
+			logger.Error("cannot save tree", "file", fname, "error", err)
+			return JSONError("SAVE FAILED"), op
+		}
+		return JSONResult(nil, "count", count), op
+	case "load":
+		fname, _, err := session.SnapshotFile(config, request.Path)
+		if err != nil {
+			return JSONResult(err), op
+		}
+		if fname == "" {
+			return JSONError("NO DATA FILE"), op
+		}
+		// Failures of the store are answered as by the other ops, those
+		// of reading the file with LOAD FAILED.
+		count, err := store.Load(fname)
+		if errors.Is(err, ErrWalFailed) || errors.Is(err, ErrReadOnly) {
+			return JSONResult(err), op
+		}
+		var unsupported *UnsupportedFormatError
+		if errors.As(err, &unsupported) {
+			return JSONError("UNSUPPORTED FORMAT " + unsupported.Version), op
+		}
+		if err != nil {
+			logger.Error("cannot load tree", "file", fname, "error", err)
+			return JSONError("LOAD FAILED"), op
+		}
+		return JSONResult(nil, "count", count), op
+	}
+	return JSONError("INVALID COMMAND"), ""
+}
@@ -0,0 +1,178 @@
+package kdstore
+
+import (
+	"context"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// checkInterval is the number of nodes a traversal visits between checks
+// of its context.
+const checkInterval = 1024
+
+// WalkContext is Walk, aborted with the error of ctx once ctx is done.
+func (store *Store) WalkContext(ctx context.Context, lower []float64, upper []float64, fn func(kdtree.Point) bool) error {
+	if store.empty() {
+		return nil
+	}
+	box := MakeRange(lower, upper)
+	type visit struct {
+		node reflect.Value
+		axis int
+	}
+	stack := []visit{{store.root(), 0}}
+	for visited := 1; len(stack) > 0; visited++ {
+		if visited%checkInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.node.IsNil() {
+			continue
+		}
+		node := top.node.Elem()
+		p := node.Field(pointField).Interface().(kdtree.Point)
+		inside := true
+		for i, limits := range box {
+			inside = inside && limits[0] <= p.Dimension(i) && p.Dimension(i) <= limits[1]
+		}
+		if inside && !fn(p) {
+			return nil
+		}
+		// Right is pushed first for Left to be visited first, as by the
+		// search of the tree.
+		axis, x := (top.axis+1)%p.Dimensions(), p.Dimension(top.axis)
+		if x <= box[top.axis][1] {
+			stack = append(stack, visit{node.Field(rightField), axis})
+		}
+		if x >= box[top.axis][0] {
+			stack = append(stack, visit{node.Field(leftField), axis})
+		}
+	}
+	return nil
+}
+
+// SearchContext is Search, aborted with the error of ctx once ctx is done.
+// A context that is never done leaves the search to the tree, which is
+// faster than traversing it by reflection.
+func (store *Store) SearchContext(ctx context.Context, lower []float64, upper []float64) ([]kdtree.Point, error) {
+	if ctx.Done() == nil {
+		return store.Search(lower, upper), nil
+	}
+	rst := []kdtree.Point{}
+	err := store.WalkContext(ctx, lower, upper, func(p kdtree.Point) bool {
+		rst = append(rst, p)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rst, nil
+}
+
+// NearestContext is Nearest, aborted with the error of ctx once ctx is
+// done. As with SearchContext, a context that is never done leaves the
+// search to the tree.
+func (store *Store) NearestContext(ctx context.Context, point []float64, k int) ([]kdtree.Point, error) {
+	if ctx.Done() == nil || store.empty() || k <= 0 {
+		return store.Nearest(point, k), nil
+	}
+	return store.ApproximateNearestContext(ctx, point, k, 0)
+}
+
+// ApproximateNearestContext is NearestContext with an error bound eps: the
+// k-th point returned is within 1+eps times the distance of the true k-th
+// nearest point. The search descends into the other side of a splitting
+// plane only when the plane is nearer than the k-th point found so far by
+// more than that factor, so that a larger eps visits fewer nodes. With eps
+// 0 it is exact.
+func (store *Store) ApproximateNearestContext(ctx context.Context, point []float64, k int, eps float64) ([]kdtree.Point, error) {
+	if store.empty() || k <= 0 {
+		return []kdtree.Point{}, nil
+	}
+	search := nearest{ctx: ctx, point: point, k: k, eps: eps}
+	if err := search.descend(store.root(), 0); err != nil {
+		return nil, err
+	}
+	rst := make([]kdtree.Point, len(search.found))
+	for i, c := range search.found {
+		rst[i] = c.point
+	}
+	return rst, nil
+}
+
+type candidate struct {
+	point    kdtree.Point
+	distance float64
+}
+
+// nearest is a search of ApproximateNearestContext. It goes the way of the
+// search of the tree: down to the leaf the point would be inserted under,
+// then back up, descending into the other side of every node whose splitting
+// plane is nearer than the k-th nearest point found so far, by a factor of
+// 1+eps.
+type nearest struct {
+	ctx   context.Context
+	point []float64
+	k     int
+	eps   float64
+	// found are the k nearest points so far, nearest first.
+	found   []candidate
+	visited int
+}
+
+// bound returns the distance of the k-th nearest point so far.
+func (search *nearest) bound() float64 {
+	if len(search.found) < search.k {
+		return math.MaxFloat64
+	}
+	return search.found[search.k-1].distance
+}
+
+func (search *nearest) insert(p kdtree.Point, distance float64) {
+	i := sort.Search(len(search.found), func(i int) bool { return search.found[i].distance > distance })
+	search.found = append(search.found, candidate{})
+	copy(search.found[i+1:], search.found[i:])
+	search.found[i] = candidate{p, distance}
+	if len(search.found) > search.k {
+		search.found = search.found[:search.k]
+	}
+}
+
+func (search *nearest) descend(start reflect.Value, axis int) error {
+	dimensions := len(search.point)
+	path := []reflect.Value{}
+	for node := start; !node.IsNil(); axis = (axis + 1) % dimensions {
+		path = append(path, node)
+		if search.point[axis] < node.Elem().Field(pointField).Interface().(kdtree.Point).Dimension(axis) {
+			node = node.Elem().Field(leftField)
+		} else {
+			node = node.Elem().Field(rightField)
+		}
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		axis = (axis - 1 + dimensions) % dimensions
+		if search.visited++; search.visited%checkInterval == 0 && search.ctx.Err() != nil {
+			return search.ctx.Err()
+		}
+		node := path[i].Elem()
+		p := node.Field(pointField).Interface().(kdtree.Point)
+		if distance := Distance(search.point, p.(*points.Point).Coordinates); distance < search.bound() {
+			search.insert(p, distance)
+		}
+		x := p.Dimension(axis)
+		if math.Abs(x-search.point[axis])*(1+search.eps) < search.bound() {
+			next := node.Field(leftField)
+			if search.point[axis] < x {
+				next = node.Field(rightField)
+			}
+			if err := search.descend(next, (axis+1)%dimensions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+// Package kdstore is the k-d tree store served by kdtreed, for programs that
+// want to embed it rather than talk to the daemon over the network:
+//
+//	var store kdstore.Store
+//	store.Add([]float64{1, 2}, "a")
+//	store.Add([]float64{3, 4}, "b")
+//	neighbours, err := store.KNN([]float64{0, 0}, 1)
+//
+// The points of a store all have the same dimension, fixed by the first
+// point added. A Store is safe for concurrent use. Its lower-level methods,
+// documented as such, leave the locking to the caller so that several of
+// them can be combined under a single lock.
+package kdstore
+
+import (
+	"context"
+	"errors"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/kdrange"
+	"github.com/kyroy/kdtree/points"
+	"math"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// Errors returned by the store operations.
+var (
+	ErrDimensionMismatch = errors.New("dimension mismatch")
+	ErrNotFound          = errors.New("not found")
+)
+
+// Result is a stored point as returned by queries.
+type Result struct {
+	Point []float64
+	Data  interface{}
+	// Distance is the distance of the point from the query point, for KNN
+	// results.
+	Distance float64
+}
+
+// Store is a k-d tree of points with payloads. The zero Store is empty and
+// ready to use.
+//
+// Every query runs under the read lock and every mutation under the write
+// lock, so a query sees the store as it was either before or after any
+// mutation, never in the middle of one. Queries return slices of their own,
+// and stored points are never modified once inserted, so results remain
+// valid after the lock is released, though a later mutation may have made
+// them stale.
+type Store struct {
+	sync.RWMutex
+	tree      *kdtree.KDTree
+	dimension int
+	count     int
+	// Epsilon is the tolerance within which Find, and thus Remove and
+	// Delete, consider coordinates equal; 0 requires exact equality.
+	Epsilon float64
+	// Capacity is the number of points Gather makes room for at least.
+	Capacity int
+}
+
+// MakeRange builds the axis-aligned box spanned by two opposite corners. The
+// corners may be given in any order.
+func MakeRange(lower []float64, upper []float64) kdrange.Range {
+	r := make(kdrange.Range, len(lower))
+	for i := range r {
+		r[i] = [2]float64{math.Min(lower[i], upper[i]), math.Max(lower[i], upper[i])}
+	}
+	return r
+}
+
+// Distance returns the Euclidean distance between two points of the same
+// dimension.
+func Distance(a []float64, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return math.Sqrt(sum)
+}
+
+// CheckDimension returns ErrDimensionMismatch unless the given points all
+// have the dimension of the stored points. The dimension is fixed by the
+// first point added to the store, so while the store is still empty the
+// points need only agree with each other. Every store operation taking
+// points checks them here, before they reach the tree, which does not check
+// dimensions itself. The caller must hold at least a read lock on the store.
+func (store *Store) CheckDimension(pts ...[]float64) error {
+	dimension := store.dimension
+	for _, point := range pts {
+		if dimension == 0 {
+			dimension = len(point)
+		}
+		if len(point) == 0 || len(point) != dimension {
+			return ErrDimensionMismatch
+		}
+	}
+	return nil
+}
+
+// empty reports whether the store holds no point, be it that no tree was
+// created yet or that every point was removed from it. Lookups, removals and
+// searches return early when it does rather than rely on the tree to handle
+// an empty root.
+func (store *Store) empty() bool {
+	return store.tree == nil || store.count == 0
+}
+
+// Insert adds a point to the store, creating the tree on the first insert.
+// The caller must hold the store lock and have checked the dimension.
+func (store *Store) Insert(point []float64, data interface{}) {
+	if store.tree == nil {
+		store.tree = kdtree.New([]kdtree.Point{})
+	}
+	if store.dimension == 0 {
+		store.dimension = len(point)
+	}
+	store.tree.Insert(points.NewPoint(point, data))
+	store.count++
+}
+
+// Lookup returns the stored point matching point, i.e. the nearest one whose
+// coordinates are all within Epsilon of those of point, or nil if there is
+// none. Only the box of that half-width around point is searched, so the
+// cost is that of descending the tree. The caller must hold at least a read
+// lock on the store.
+func (store *Store) Lookup(point []float64) kdtree.Point {
+	if store.empty() || store.CheckDimension(point) != nil {
+		return nil
+	}
+	lower := make([]float64, len(point))
+	upper := make([]float64, len(point))
+	for i, x := range point {
+		lower[i], upper[i] = x-store.Epsilon, x+store.Epsilon
+	}
+	var found kdtree.Point
+	for _, p := range store.tree.RangeSearch(MakeRange(lower, upper)) {
+		if found == nil || Distance(point, p.(*points.Point).Coordinates) < Distance(point, found.(*points.Point).Coordinates) {
+			found = p
+		}
+	}
+	return found
+}
+
+// Find returns the coordinates of the stored point matching point, as found
+// by Lookup, or nil if there is none. The caller must hold at least a read
+// lock on the store.
+func (store *Store) Find(point []float64) []float64 {
+	if found := store.Lookup(point); found != nil {
+		return found.(*points.Point).Coordinates
+	}
+	return nil
+}
+
+// RemoveExact deletes a point with exactly the given coordinates and reports
+// whether there was one. The caller must hold the store lock.
+func (store *Store) RemoveExact(point []float64) bool {
+	if store.empty() || store.tree.Remove(&points.Point{Coordinates: point}) == nil {
+		return false
+	}
+	store.count--
+	return true
+}
+
+// Remove deletes the point matching the given coordinates, as found by Find,
+// and returns its exact coordinates, or nil if there is none. The caller must
+// hold the store lock.
+func (store *Store) Remove(point []float64) []float64 {
+	found := store.Find(point)
+	if found == nil || !store.RemoveExact(found) {
+		return nil
+	}
+	return found
+}
+
+// Reset replaces the contents of the store with a balanced tree of pts. The
+// caller must hold the store lock.
+func (store *Store) Reset(pts []kdtree.Point) {
+	store.tree = kdtree.New(pts)
+	store.count = len(pts)
+	store.dimension = 0
+	if len(pts) > 0 {
+		store.dimension = pts[0].Dimensions()
+	}
+}
+
+// Swap replaces the points of the store with those of side, which is left
+// empty. Side can be filled without holding the lock of the store, so that
+// the lock is only held for the swap itself. The caller must hold the store
+// lock.
+func (store *Store) Swap(side *Store) {
+	store.tree, store.dimension, store.count = side.tree, side.dimension, side.count
+	side.tree, side.dimension, side.count = nil, 0, 0
+}
+
+// Points returns every stored point. The caller must hold at least a read
+// lock on the store.
+func (store *Store) Points() []kdtree.Point {
+	if store.tree == nil {
+		return []kdtree.Point{}
+	}
+	return store.tree.Points()
+}
+
+// Gather returns every stored point in a slice with room for at least n
+// points, or for Capacity if that is more. The caller must hold at least a
+// read lock on the store.
+func (store *Store) Gather(n int) []kdtree.Point {
+	if n < store.Capacity {
+		n = store.Capacity
+	}
+	return append(make([]kdtree.Point, 0, n), store.Points()...)
+}
+
+// Nearest returns up to k points nearest to point, nearest first. The caller
+// must hold at least a read lock on the store and have checked the
+// dimension.
+func (store *Store) Nearest(point []float64, k int) []kdtree.Point {
+	if store.empty() {
+		return []kdtree.Point{}
+	}
+	return store.tree.KNN(&points.Point{Coordinates: point}, k)
+}
+
+// Search returns the points inside the box spanned by two opposite corners.
+// The caller must hold at least a read lock on the store and have checked
+// the dimension.
+func (store *Store) Search(lower []float64, upper []float64) []kdtree.Point {
+	if store.empty() {
+		return []kdtree.Point{}
+	}
+	return store.tree.RangeSearch(MakeRange(lower, upper))
+}
+
+// Bounds returns the lower and upper corners of the smallest axis-aligned box
+// holding every point, or nil corners while the store is empty. The caller
+// must hold at least a read lock on the store.
+func (store *Store) Bounds() ([]float64, []float64) {
+	if store.count == 0 {
+		return nil, nil
+	}
+	lower := make([]float64, store.dimension)
+	upper := make([]float64, store.dimension)
+	// The walk spans all of space, as the box is only known at its end.
+	from := make([]float64, store.dimension)
+	to := make([]float64, store.dimension)
+	for i := range lower {
+		lower[i], upper[i] = math.Inf(1), math.Inf(-1)
+		from[i], to[i] = math.Inf(-1), math.Inf(1)
+	}
+	store.Walk(from, to, func(p kdtree.Point) bool {
+		for i := range lower {
+			lower[i] = math.Min(lower[i], p.Dimension(i))
+			upper[i] = math.Max(upper[i], p.Dimension(i))
+		}
+		return true
+	})
+	return lower, upper
+}
+
+// Count returns the number of stored points. The caller must hold at least a
+// read lock on the store.
+func (store *Store) Count() int {
+	return store.count
+}
+
+// Dimension returns the dimension of the stored points, or 0 before the
+// first point is added. The caller must hold at least a read lock on the
+// store.
+func (store *Store) Dimension() int {
+	return store.dimension
+}
+
+// The fields of a node of the tree, in the order it declares them. They are
+// read by index, as looking them up by name on every node visited costs
+// more than the rest of a search.
+const (
+	pointField = iota
+	leftField
+	rightField
+)
+
+// root returns the root node of the tree. The tree does not expose its
+// nodes, so they are reached by reflection on its unexported fields, and
+// through unsafe to be allowed to read the points they hold.
+func (store *Store) root() reflect.Value {
+	field := reflect.ValueOf(store.tree).Elem().FieldByName("root")
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
+
+// Depth returns the number of levels of the tree, 0 while it is empty. The
+// caller must hold at least a read lock on the store.
+func (store *Store) Depth() int {
+	if store.tree == nil {
+		return 0
+	}
+	type level struct {
+		node  reflect.Value
+		depth int
+	}
+	depth := 0
+	stack := []level{{store.root(), 1}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.node.IsNil() {
+			continue
+		}
+		if top.depth > depth {
+			depth = top.depth
+		}
+		node := top.node.Elem()
+		stack = append(stack, level{node.Field(leftField), top.depth + 1}, level{node.Field(rightField), top.depth + 1})
+	}
+	return depth
+}
+
+// Walk calls fn for every point inside the box spanned by two opposite
+// corners as the traversal of the tree finds it, rather than collecting the
+// points first, and stops early when fn returns false. The points are those
+// Search returns, in the same order, but only the path to the current node
+// is kept in memory. The caller must hold at least a read lock on the store
+// for the whole walk and have checked the dimension.
+func (store *Store) Walk(lower []float64, upper []float64, fn func(kdtree.Point) bool) {
+	store.WalkContext(context.Background(), lower, upper, fn)
+}
+
+// Add inserts a point with its payload.
+func (store *Store) Add(point []float64, data interface{}) error {
+	store.Lock()
+	defer store.Unlock()
+	if err := store.CheckDimension(point); err != nil {
+		return err
+	}
+	store.Insert(point, data)
+	return nil
+}
+
+// Delete removes the point matching the given coordinates, as found by Find.
+func (store *Store) Delete(point []float64) error {
+	store.Lock()
+	defer store.Unlock()
+	if err := store.CheckDimension(point); err != nil {
+		return err
+	}
+	if store.Remove(point) == nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Get returns the point matching the given coordinates, as found by Lookup.
+func (store *Store) Get(point []float64) (Result, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(point); err != nil {
+		return Result{}, err
+	}
+	found := store.Lookup(point)
+	if found == nil {
+		return Result{}, ErrNotFound
+	}
+	return Results([]kdtree.Point{found}, nil)[0], nil
+}
+
+// KNN returns up to k points nearest to point, nearest first.
+func (store *Store) KNN(point []float64, k int) ([]Result, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(point); err != nil {
+		return nil, err
+	}
+	return Results(store.Nearest(point, k), point), nil
+}
+
+// Range returns the points inside the box spanned by two opposite corners.
+func (store *Store) Range(lower []float64, upper []float64) ([]Result, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(lower, upper); err != nil {
+		return nil, err
+	}
+	return Results(store.Search(lower, upper), nil), nil
+}
+
+// Stats returns the number of stored points and their dimension, which is 0
+// while the store is empty.
+func (store *Store) Stats() (int, int) {
+	store.RLock()
+	defer store.RUnlock()
+	return store.count, store.dimension
+}
+
+// DepthStats returns the depth of the tree, walked once under the read lock,
+// and the depth of a balanced tree of as many points, ceil(log2(n+1)). The
+// further the first exceeds the second, the more queries would gain from
+// rebalancing.
+func (store *Store) DepthStats() (int, int) {
+	store.RLock()
+	defer store.RUnlock()
+	return store.Depth(), int(math.Ceil(math.Log2(float64(store.count + 1))))
+}
+
+// Results converts points of the tree to Results, with their distances from
+// query unless it is nil.
+func Results(pts []kdtree.Point, query []float64) []Result {
+	rst := make([]Result, len(pts))
+	for i, p := range pts {
+		point := p.(*points.Point)
+		rst[i] = Result{Point: point.Coordinates, Data: point.Data}
+		if query != nil {
+			rst[i].Distance = Distance(query, point.Coordinates)
+		}
+	}
+	return rst
+}
@@ -0,0 +1,198 @@
+package kdstore
+
+import (
+	"context"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestTreeLayout checks the unexported fields of the tree that root and the
+// traversals read, so that a change of them in a new version of kdtree
+// fails here rather than panics in a search.
+func TestTreeLayout(t *testing.T) {
+	root, ok := reflect.TypeOf(kdtree.KDTree{}).FieldByName("root")
+	if !ok {
+		t.Fatal("KDTree has no root field")
+	}
+	if root.Type.Kind() != reflect.Ptr || root.Type.Elem().Kind() != reflect.Struct {
+		t.Fatalf("the root of KDTree is a %v, not a pointer to a node", root.Type)
+	}
+	node := root.Type.Elem()
+	fields := []struct {
+		index int
+		name  string
+		typ   reflect.Type
+	}{
+		{pointField, "Point", reflect.TypeOf((*kdtree.Point)(nil)).Elem()},
+		{leftField, "Left", root.Type},
+		{rightField, "Right", root.Type},
+	}
+	if node.NumField() < len(fields) {
+		t.Fatalf("a node has %d fields, want at least %d", node.NumField(), len(fields))
+	}
+	for _, want := range fields {
+		field := node.Field(want.index)
+		if field.Name != want.name || field.Type != want.typ {
+			t.Errorf("field %d of a node is %s %v, want %s %v", want.index, field.Name, field.Type, want.name, want.typ)
+		}
+	}
+}
+
+// scatter returns a store of n random points of dimension 3, with their
+// indices as payloads, and the points themselves.
+func scatter(t *testing.T, source *rand.Rand, n int) (*Store, [][]float64) {
+	t.Helper()
+	store := &Store{}
+	pts := make([][]float64, n)
+	for i := range pts {
+		pts[i] = []float64{source.Float64(), source.Float64(), source.Float64()}
+		if err := store.Add(pts[i], i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store, pts
+}
+
+func TestWalk(t *testing.T) {
+	source := rand.New(rand.NewSource(1))
+	store, pts := scatter(t, source, 2000)
+	for q := 0; q < 50; q++ {
+		lower := []float64{source.Float64(), source.Float64(), source.Float64()}
+		upper := []float64{source.Float64(), source.Float64(), source.Float64()}
+		box := MakeRange(lower, upper)
+		want := map[int]bool{}
+		for i, p := range pts {
+			inside := true
+			for axis, limits := range box {
+				inside = inside && limits[0] <= p[axis] && p[axis] <= limits[1]
+			}
+			if inside {
+				want[i] = true
+			}
+		}
+		got := []kdtree.Point{}
+		store.Walk(lower, upper, func(p kdtree.Point) bool {
+			got = append(got, p)
+			return true
+		})
+		if len(got) != len(want) {
+			t.Fatalf("%v %v: walked %d points, want %d", lower, upper, len(got), len(want))
+		}
+		for _, p := range got {
+			if !want[p.(*points.Point).Data.(int)] {
+				t.Errorf("%v %v: walked %v, outside the box", lower, upper, p)
+			}
+		}
+		if search := store.Search(lower, upper); !reflect.DeepEqual(got, search) {
+			t.Errorf("%v %v: walked the points in another order than Search", lower, upper)
+		}
+	}
+	walked := 0
+	store.Walk([]float64{0, 0, 0}, []float64{1, 1, 1}, func(kdtree.Point) bool {
+		walked++
+		return walked < 10
+	})
+	if walked != 10 {
+		t.Errorf("walked %d points after fn returned false at the 10th", walked)
+	}
+}
+
+func TestDepth(t *testing.T) {
+	store := &Store{}
+	if depth := store.Depth(); depth != 0 {
+		t.Errorf("depth of the empty store is %d, want 0", depth)
+	}
+	// Points added in increasing order all go to the right of the last.
+	for i := 0; i < 20; i++ {
+		store.Add([]float64{float64(i), float64(i)}, i)
+	}
+	if depth := store.Depth(); depth != 20 {
+		t.Errorf("depth of a chain of 20 points is %d, want 20", depth)
+	}
+	for _, n := range []int{1, 2, 3, 7, 8, 100, 1023, 1024} {
+		pts := make([]kdtree.Point, n)
+		for i := range pts {
+			pts[i] = points.NewPoint([]float64{float64(i), float64(n - i)}, i)
+		}
+		store.Reset(pts)
+		if depth, want := store.Depth(), int(math.Ceil(math.Log2(float64(n+1)))); depth != want {
+			t.Errorf("depth of a balanced tree of %d points is %d, want %d", n, depth, want)
+		}
+	}
+}
+
+// nearestDistances returns the distances from point of its k nearest
+// points, by sorting those of every point.
+func nearestDistances(pts [][]float64, point []float64, k int) []float64 {
+	distances := make([]float64, len(pts))
+	for i, p := range pts {
+		distances[i] = Distance(point, p)
+	}
+	sort.Float64s(distances)
+	if k < len(distances) {
+		distances = distances[:k]
+	}
+	return distances
+}
+
+func TestNearestContext(t *testing.T) {
+	source := rand.New(rand.NewSource(2))
+	store, pts := scatter(t, source, 3000)
+	// A context that can be done makes the search traverse the tree itself
+	// rather than leave it to the tree.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for q := 0; q < 100; q++ {
+		point := []float64{source.Float64()*1.2 - 0.1, source.Float64()*1.2 - 0.1, source.Float64()*1.2 - 0.1}
+		k := 1 + source.Intn(20)
+		got, err := store.NearestContext(ctx, point, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := nearestDistances(pts, point, k)
+		if len(got) != len(want) {
+			t.Fatalf("%v %d: got %d points, want %d", point, k, len(got), len(want))
+		}
+		for i, p := range got {
+			if distance := Distance(point, p.(*points.Point).Coordinates); distance != want[i] {
+				t.Errorf("%v %d: point %d is at %v, want %v", point, k, i, distance, want[i])
+			}
+		}
+	}
+	if got, err := store.NearestContext(ctx, []float64{0, 0, 0}, len(pts)+5); err != nil || len(got) != len(pts) {
+		t.Errorf("k over the count: got %d points and %v, want %d", len(got), err, len(pts))
+	}
+	cancel()
+	if _, err := store.NearestContext(ctx, []float64{0, 0, 0}, len(pts)); err != context.Canceled {
+		t.Errorf("search with a canceled context returned %v", err)
+	}
+}
+
+func TestApproximateNearestContext(t *testing.T) {
+	source := rand.New(rand.NewSource(3))
+	store, pts := scatter(t, source, 3000)
+	for _, eps := range []float64{0, 0.5, 2} {
+		for q := 0; q < 100; q++ {
+			point := []float64{source.Float64(), source.Float64(), source.Float64()}
+			k := 1 + source.Intn(20)
+			got, err := store.ApproximateNearestContext(context.Background(), point, k, eps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := nearestDistances(pts, point, k)
+			if len(got) != len(want) {
+				t.Fatalf("%v %d EPS=%v: got %d points, want %d", point, k, eps, len(got), len(want))
+			}
+			for i, p := range got {
+				if distance := Distance(point, p.(*points.Point).Coordinates); distance > want[i]*(1+eps) {
+					t.Errorf("%v %d EPS=%v: point %d is at %v, beyond 1+EPS times %v", point, k, eps, i, distance, want[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels, from the most to the least verbose.
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// Logger writes leveled log lines as space-separated key=value pairs, e.g.
+//
+//	time=2020-05-01T10:00:00Z level=info msg="accepted connection" remote=127.0.0.1:5000
+//
+// Values containing spaces, quotes or equal signs are quoted.
+type Logger struct {
+	level int32
+	out   *log.Logger
+}
+
+// logger is the daemon-wide logger, configured from ServerConfig.LogLevel.
+var logger = NewLogger(LevelInfo)
+
+func NewLogger(level int) *Logger {
+	return &Logger{level: int32(level), out: log.New(os.Stderr, "", 0)}
+}
+
+// ParseLogLevel maps a level name such as "warn" to its level.
+func ParseLogLevel(name string) (int, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// SetLevel changes the least severe level that is logged.
+func (logger *Logger) SetLevel(level int) {
+	atomic.StoreInt32(&logger.level, int32(level))
+}
+
+func (logger *Logger) Debug(msg string, kv ...interface{}) { logger.log(LevelDebug, msg, kv) }
+func (logger *Logger) Info(msg string, kv ...interface{})  { logger.log(LevelInfo, msg, kv) }
+func (logger *Logger) Warn(msg string, kv ...interface{})  { logger.log(LevelWarn, msg, kv) }
+func (logger *Logger) Error(msg string, kv ...interface{}) { logger.log(LevelError, msg, kv) }
+
+// Fatal logs at error level and exits.
+func (logger *Logger) Fatal(msg string, kv ...interface{}) {
+	logger.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (logger *Logger) log(level int, msg string, kv []interface{}) {
+	if int32(level) < atomic.LoadInt32(&logger.level) {
+		return
+	}
+	var line strings.Builder
+	line.WriteString("time=" + time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(" level=" + levelNames[level])
+	line.WriteString(" msg=" + formatLogValue(msg))
+	for i := 0; i+1 < len(kv); i += 2 {
+		line.WriteString(fmt.Sprintf(" %v=%s", kv[i], formatLogValue(kv[i+1])))
+	}
+	logger.out.Println(line.String())
+}
+
+func formatLogValue(value interface{}) string {
+	str := fmt.Sprint(value)
+	if str == "" || strings.ContainsAny(str, " =\"\t\r\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
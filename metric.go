@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"github.com/etude-ist/kdtreed/kdstore"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math"
+	"sort"
+)
+
+// DistanceFunc measures the distance between two points of the same
+// dimension.
+type DistanceFunc func(a []float64, b []float64) float64
+
+// DistanceMetrics are the metrics KNN, NEAREST and BALL can rank points by,
+// selected with the distance_metric config option or per connection with
+// METRIC. RANGE is a box query and does not depend on the metric.
+var DistanceMetrics = map[string]DistanceFunc{
+	"EUCLIDEAN": kdstore.Distance,
+	"MANHATTAN": ManhattanDistance,
+	"CHEBYSHEV": ChebyshevDistance,
+}
+
+// ManhattanDistance returns the L1 distance between two points.
+func ManhattanDistance(a []float64, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += math.Abs(a[i] - b[i])
+	}
+	return sum
+}
+
+// ChebyshevDistance returns the L∞ distance between two points.
+func ChebyshevDistance(a []float64, b []float64) float64 {
+	max := 0.0
+	for i := range a {
+		max = math.Max(max, math.Abs(a[i]-b[i]))
+	}
+	return max
+}
+
+// ScoreKernels turn the distance of a KNN result into a similarity score in
+// (0, 1], 1 at the query point itself, for KNN ... SCORE. The bandwidth is
+// the distance at which inverse scores 1/2, and the standard deviation of
+// gaussian.
+var ScoreKernels = map[string]func(distance float64, bandwidth float64) float64{
+	"inverse": func(distance float64, bandwidth float64) float64 {
+		return 1 / (1 + distance/bandwidth)
+	},
+	"gaussian": func(distance float64, bandwidth float64) float64 {
+		return math.Exp(-distance * distance / (2 * bandwidth * bandwidth))
+	},
+}
+
+// MetricLowerBounds bound the distance between two points of the given
+// dimension under each metric from below, given their Euclidean distance.
+var MetricLowerBounds = map[string]func(euclidean float64, dimension int) float64{
+	"EUCLIDEAN": func(euclidean float64, dimension int) float64 { return euclidean },
+	"MANHATTAN": func(euclidean float64, dimension int) float64 { return euclidean },
+	"CHEBYSHEV": func(euclidean float64, dimension int) float64 {
+		return euclidean / math.Sqrt(float64(dimension))
+	},
+}
+
+// MetricKNN returns up to k points nearest to point under the given metric,
+// nearest first. With an error bound eps > 0 the result is approximate: the
+// k-th point returned is within 1+eps times the distance of the true k-th
+// neighbour. The caller must hold at least a read lock on the store.
+//
+// The tree only knows Euclidean neighbours, but the k of them are as good a
+// set of candidates as any: the true neighbours are no farther than the
+// farthest of them, and all lie in the box of that half-width around point,
+// which the tree can search.
+//
+// Searching the box is what eps saves. Any k points include one at least as
+// far as the k-th Euclidean candidate, so the true k-th distance is at least
+// the lower bound of the metric for that Euclidean distance, and when the
+// farthest candidate is within 1+eps of it the candidates are returned as
+// they are. The saving grows with eps, but under CHEBYSHEV the bound loosens
+// with the square root of the dimension, so high-dimensional queries need a
+// large eps to benefit.
+//
+// Under EUCLIDEAN the candidates are the result, and eps instead prunes the
+// search of the tree itself, see ApproximateNearestContext.
+func (store *KdtreeStore) MetricKNN(ctx context.Context, point []float64, k int, metric string, eps float64) ([]kdtree.Point, error) {
+	if metric == "EUCLIDEAN" && eps > 0 {
+		return store.ApproximateNearestContext(ctx, point, k, eps)
+	}
+	candidates, err := store.NearestContext(ctx, point, k)
+	distance := DistanceMetrics[metric]
+	if err != nil || metric == "EUCLIDEAN" || len(candidates) == 0 {
+		return candidates, err
+	}
+	radius := 0.0
+	for _, p := range candidates {
+		radius = math.Max(radius, distance(point, p.(*points.Point).Coordinates))
+	}
+	rst := candidates
+	if eps == 0 || len(candidates) < k ||
+		radius > (1+eps)*MetricLowerBounds[metric](kdstore.Distance(point, candidates[k-1].(*points.Point).Coordinates), len(point)) {
+		lower := make([]float64, len(point))
+		upper := make([]float64, len(point))
+		for i, x := range point {
+			lower[i], upper[i] = x-radius, x+radius
+		}
+		if rst, err = store.SearchContext(ctx, lower, upper); err != nil {
+			return nil, err
+		}
+	}
+	distances := make(map[kdtree.Point]float64, len(rst))
+	for _, p := range rst {
+		distances[p] = distance(point, p.(*points.Point).Coordinates)
+	}
+	sort.SliceStable(rst, func(i, j int) bool { return distances[rst[i]] < distances[rst[j]] })
+	if len(rst) > k {
+		rst = rst[:k]
+	}
+	return rst, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the command latency
+// histogram buckets.
+var LatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Histogram accumulates command latencies into LatencyBuckets.
+type Histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// Metrics collects per-action command counts and latencies. A nil *Metrics
+// ignores observations, so callers need not check whether metrics are on.
+type Metrics struct {
+	sync.Mutex
+	latency map[string]*Histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{latency: make(map[string]*Histogram)}
+}
+
+// Observe records that a command with the given action took d.
+func (metrics *Metrics) Observe(action string, d time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	action = strings.ToLower(action)
+	histogram, ok := metrics.latency[action]
+	if !ok {
+		histogram = &Histogram{buckets: make([]uint64, len(LatencyBuckets))}
+		metrics.latency[action] = histogram
+	}
+	seconds := d.Seconds()
+	for i, bound := range LatencyBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.sum += seconds
+	histogram.count++
+}
+
+// MetricsHandler serves the metrics of the store in the Prometheus text
+// exposition format.
+func MetricsHandler(store *KdtreeStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.RLock()
+		count := store.Count()
+		store.RUnlock()
+
+		metrics := store.metrics
+		metrics.Lock()
+		defer metrics.Unlock()
+		actions := make([]string, 0, len(metrics.latency))
+		for action := range metrics.latency {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# HELP kdtreed_points Number of points stored in the tree.")
+		fmt.Fprintln(w, "# TYPE kdtreed_points gauge")
+		fmt.Fprintln(w, "kdtreed_points", count)
+
+		fmt.Fprintln(w, "# HELP kdtreed_commands_total Number of commands processed, by action.")
+		fmt.Fprintln(w, "# TYPE kdtreed_commands_total counter")
+		for _, action := range actions {
+			fmt.Fprintf(w, "kdtreed_commands_total{action=%q} %d\n", action, metrics.latency[action].count)
+		}
+
+		fmt.Fprintln(w, "# HELP kdtreed_command_duration_seconds Time taken to process a command, by action.")
+		fmt.Fprintln(w, "# TYPE kdtreed_command_duration_seconds histogram")
+		for _, action := range actions {
+			histogram := metrics.latency[action]
+			for i, bound := range LatencyBuckets {
+				fmt.Fprintf(w, "kdtreed_command_duration_seconds_bucket{action=%q,le=\"%g\"} %d\n", action, bound, histogram.buckets[i])
+			}
+			fmt.Fprintf(w, "kdtreed_command_duration_seconds_bucket{action=%q,le=\"+Inf\"} %d\n", action, histogram.count)
+			fmt.Fprintf(w, "kdtreed_command_duration_seconds_sum{action=%q} %g\n", action, histogram.sum)
+			fmt.Fprintf(w, "kdtreed_command_duration_seconds_count{action=%q} %d\n", action, histogram.count)
+		}
+	})
+}
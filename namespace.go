@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+// DefaultNamespace is the namespace connections start in. Its store is the
+// one loaded from and saved to the data file, logged to the write-ahead log
+// and served by the REST API and the metrics.
+const DefaultNamespace = "default"
+
+// Namespaces holds the stores selected by name with USE. Each namespace is an
+// independent tree, created on first use with the settings of the default
+// store but kept in memory only.
+type Namespaces struct {
+	sync.Mutex
+	stores map[string]*KdtreeStore
+	// drained is set by Drain, so that namespaces created later are
+	// drained as well.
+	drained bool
+}
+
+// NewNamespaces returns the namespaces of a daemon whose default store is
+// store.
+func NewNamespaces(store *KdtreeStore) *Namespaces {
+	return &Namespaces{stores: map[string]*KdtreeStore{DefaultNamespace: store}}
+}
+
+// Get returns the store of the named namespace, creating it if need be.
+func (namespaces *Namespaces) Get(name string) *KdtreeStore {
+	namespaces.Lock()
+	defer namespaces.Unlock()
+	store := namespaces.stores[name]
+	if store == nil {
+		defaults := namespaces.stores[DefaultNamespace]
+		store = &KdtreeStore{metrics: defaults.metrics, maxK: defaults.maxK, duplicates: defaults.duplicates}
+		store.Epsilon = defaults.Epsilon
+		store.Capacity = defaults.Capacity
+		if defaults.dedup != nil {
+			store.dedup = NewDedup(defaults.dedup.window)
+		}
+		store.drained = namespaces.drained
+		namespaces.stores[name] = store
+		logger.Info("created namespace", "namespace", name)
+	}
+	return store
+}
+
+// Drain drains the store of every namespace, and of those created later.
+func (namespaces *Namespaces) Drain() {
+	namespaces.Lock()
+	defer namespaces.Unlock()
+	namespaces.drained = true
+	for _, store := range namespaces.stores {
+		store.Drain()
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/etude-ist/kdtreed/protocol"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatPoint renders stored coordinates in the `{x, y, ...}` syntax the
+// parser accepts, unscaled to the units of clients, as protocol.FormatPoint
+// does.
+func FormatPoint(coordinates []float64) string {
+	return protocol.FormatPoint(Unscale(coordinates))
+}
+
+// FormatRecord renders a stored point as `{x, y, ...} data`, i.e. an ADD
+// command without its action. Responses listing points use it too, so that
+// they can be fed back to the server as they are.
+func FormatRecord(p kdtree.Point) string {
+	point := p.(*points.Point)
+	return fmt.Sprintf("%s %v", FormatPoint(point.Coordinates), point.Data)
+}
+
+// FormatStamped renders a stored point as FormatRecord does, followed by the
+// time it was added, `{x, y, ...} data @2006-01-02T15:04:05Z`, if it has
+// one. The data file, the write-ahead log and DUMP use it so that the times
+// survive saving and replaying.
+func FormatStamped(p kdtree.Point) string {
+	added := p.(*points.Point).Data.(Data).added
+	if added.IsZero() {
+		return FormatRecord(p)
+	}
+	return FormatRecord(p) + " @" + added.UTC().Format(time.RFC3339Nano)
+}
+
+// FormatMagic and FormatVersion make up the header line the data file starts
+// with, `KDTREED 1`, so that a file of a format this build cannot read is
+// rejected rather than misread. Files written before the header was
+// introduced have none and are read as version 1.
+const (
+	FormatMagic   = "KDTREED"
+	FormatVersion = 1
+)
+
+// UnsupportedFormatError is returned by LoadTree for a data file of another
+// format version than FormatVersion.
+type UnsupportedFormatError struct {
+	Version string
+}
+
+func (err *UnsupportedFormatError) Error() string {
+	return "unsupported format " + err.Version
+}
+
+// SaveTree writes the header and one record per point to fname, replacing
+// its contents.
+// The records are written to a temporary file in the same directory which is
+// then renamed over fname, so a crash mid-write leaves the old file intact.
+func SaveTree(fname string, pts []kdtree.Point) error {
+	file, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := writeRecords(file, pts); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), fname)
+}
+
+func writeRecords(file *os.File, pts []kdtree.Point) error {
+	writer := bufio.NewWriter(file)
+	if _, err := fmt.Fprintf(writer, "%s %d\n", FormatMagic, FormatVersion); err != nil {
+		return err
+	}
+	for _, p := range pts {
+		if _, err := writer.WriteString(FormatStamped(p) + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Save writes the current points of the store to fname under a read lock and
+// returns how many were written. When fname is the data file the store is
+// loaded from on startup, checkpoint is set: once the snapshot is on disk the
+// write-ahead log is truncated; the read lock keeps mutations, and thus log
+// appends, out until then.
+func (store *KdtreeStore) Save(fname string, checkpoint bool) (int, error) {
+	store.RLock()
+	defer store.RUnlock()
+	pts := store.Points()
+	if err := SaveTree(fname, pts); err != nil {
+		return 0, err
+	}
+	if checkpoint && store.wal != nil {
+		if err := store.wal.Truncate(); err != nil {
+			return len(pts), err
+		}
+	}
+	return len(pts), nil
+}
+
+// SnapshotPath returns the file in the SnapshotDir a client names with path
+// in SAVE or LOAD. Clients may only reach the files of that directory, so
+// absolute paths and paths with a .. element are refused with
+// ErrInvalidPath, and every path with ErrNoSnapshotDir when there is none.
+func SnapshotPath(config *ServerConfig, path string) (string, error) {
+	if config.SnapshotDir == "" {
+		return "", ErrNoSnapshotDir
+	}
+	if filepath.IsAbs(path) || filepath.VolumeName(path) != "" {
+		return "", ErrInvalidPath
+	}
+	for _, element := range strings.Split(filepath.ToSlash(path), "/") {
+		if element == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+	return filepath.Join(config.SnapshotDir, path), nil
+}
+
+// Snapshot saves the store to fname every interval, forever.
+func Snapshot(store *KdtreeStore, fname string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		count, err := store.Save(fname, true)
+		if err != nil {
+			logger.Error("cannot save snapshot", "file", fname, "error", err)
+			continue
+		}
+		logger.Info("saved snapshot", "file", fname, "points", count)
+	}
+}
+
+// Load replaces the contents of the store with the records of fname and
+// returns how many were loaded. The file is read before the write lock is
+// taken, and the tree is swapped under it, so readers see either the old or
+// the new points. The write-ahead log records the load as a CLEAR followed
+// by the loaded points.
+func (store *KdtreeStore) Load(fname string) (int, error) {
+	pts, err := LoadTree(fname, store.Capacity)
+	if err != nil {
+		return 0, err
+	}
+	commands := make([]string, len(pts)+1)
+	commands[0] = "CLEAR"
+	for i, p := range pts {
+		commands[i+1] = "ADD " + FormatStamped(p)
+	}
+	store.Lock()
+	defer store.Unlock()
+	if store.drained {
+		return 0, ErrReadOnly
+	}
+	store.Reset(pts)
+	return len(pts), store.Log(strings.Join(commands, "\n"))
+}
+
+// RecordLength bounds the length of a line of the data file, so that
+// LoadTree reads any record the protocol accepts: a point of MaxDimensions
+// coordinates, of at most 24 bytes each and their separators, and its time
+// of addition after a payload of MaxPayloadBytes, counted twice for vectors
+// whose elements format longer than they were sent, e.g. .5 as 0.5. Lines
+// are unbounded if either limit is 0, and never bounded below the default
+// token size of bufio.Scanner.
+func RecordLength() int {
+	if MaxDimensions == 0 || MaxPayloadBytes == 0 {
+		return math.MaxInt
+	}
+	n := 2 + 26*MaxDimensions + 2*MaxPayloadBytes + len(" @"+time.RFC3339Nano)
+	if n < bufio.MaxScanTokenSize {
+		return bufio.MaxScanTokenSize
+	}
+	return n
+}
+
+// LoadTree reads the records written by SaveTree, after checking the format
+// version of the header if there is one. Every record is parsed as the
+// payload of an ADD command, so the file format follows the protocol.
+// Room is made for capacity points upfront, to spare growing the slice
+// record by record when the size of the file is known in advance.
+func LoadTree(fname string, capacity int) ([]kdtree.Point, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pts := make([]kdtree.Point, 0, capacity)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), RecordLength())
+	for line := 1; scanner.Scan(); line++ {
+		if fields := strings.Fields(scanner.Text()); line == 1 && len(fields) > 0 && fields[0] == FormatMagic {
+			version := strings.Join(fields[1:], " ")
+			if version != strconv.Itoa(FormatVersion) {
+				return nil, &UnsupportedFormatError{Version: version}
+			}
+			continue
+		}
+		expr := ParseKDtreeCommand("ADD " + scanner.Text())
+		if !expr.valid || expr.action != "ADD" {
+			return nil, fmt.Errorf("%s:%d: invalid record", fname, line)
+		}
+		if len(pts) > 0 && pts[0].Dimensions() != len(expr.point) {
+			return nil, fmt.Errorf("%s:%d: dimension mismatch", fname, line)
+		}
+		pts = append(pts, points.NewPoint(expr.point, expr.data))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pts, nil
+}
+
+// LoadCSV reads points from a CSV file with one point per row, its
+// coordinates followed by its payload, e.g. `1.5,2,42`. Payloads that are not
+// integers or bracketed vectors are stored as strings. Malformed rows, such
+// as a header, and rows of another dimension than the first valid one are
+// logged and skipped; LoadCSV returns how many were.
+func LoadCSV(fname string, capacity int) ([]kdtree.Point, int, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	pts := make([]kdtree.Point, 0, capacity)
+	skipped := 0
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return pts, skipped, nil
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			logger.Warn("skipping malformed seed row", "file", fname, "line", line, "error", err)
+			skipped++
+			continue
+		}
+		if err != nil {
+			return nil, skipped, err
+		}
+		var expr Expr
+		if len(row) >= 2 {
+			data := strings.TrimSpace(row[len(row)-1])
+			if probe := (Expr{buffer: data}); !IsData(&probe) || probe.position != len(data) {
+				// Not a payload of the protocol, so a bare string.
+				data = strconv.Quote(data)
+			}
+			expr = ParseKDtreeCommand(fmt.Sprintf("ADD {%s} %s", strings.Join(row[:len(row)-1], ","), data))
+		}
+		if !expr.valid || expr.action != "ADD" || len(pts) > 0 && pts[0].Dimensions() != len(expr.point) {
+			logger.Warn("skipping malformed seed row", "file", fname, "line", line)
+			skipped++
+			continue
+		}
+		pts = append(pts, points.NewPoint(expr.point, expr.data))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkLoadTree loads a data file of 1M points with and without room
+// made for them upfront, as initial_capacity does.
+func BenchmarkLoadTree(b *testing.B) {
+	const n = 1000000
+	source := rand.New(rand.NewSource(1))
+	pts := make([]kdtree.Point, n)
+	for i := range pts {
+		pts[i] = points.NewPoint([]float64{source.Float64(), source.Float64()}, Data{value: i})
+	}
+	fname := filepath.Join(b.TempDir(), "data.txt")
+	if err := SaveTree(fname, pts); err != nil {
+		b.Fatal(err)
+	}
+	for _, capacity := range []struct {
+		name string
+		n    int
+	}{{"grown", 0}, {"preallocated", n}} {
+		b.Run(capacity.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := LoadTree(fname, capacity.n); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestLoadTreeLongRecord loads a record longer than the default token of
+// bufio.Scanner, which the protocol accepts under max_payload_bytes.
+func TestLoadTreeLongRecord(t *testing.T) {
+	dimensions, payload := MaxDimensions, MaxPayloadBytes
+	t.Cleanup(func() { MaxDimensions, MaxPayloadBytes = dimensions, payload })
+	MaxDimensions, MaxPayloadBytes = 1024, 1<<20
+	expr := ParseKDtreeCommand(`ADD {1, 2} "` + strings.Repeat("x", 100000) + `"`)
+	if !expr.valid {
+		t.Fatal("the long record is rejected")
+	}
+	saved := points.NewPoint(expr.point, expr.data)
+	fname := filepath.Join(t.TempDir(), "data.txt")
+	if err := SaveTree(fname, []kdtree.Point{saved}); err != nil {
+		t.Fatal(err)
+	}
+	pts, err := LoadTree(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 1 || FormatRecord(pts[0]) != FormatRecord(saved) {
+		t.Errorf("loaded %d points, not the saved one", len(pts))
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// PprofHandler serves the profiles of net/http/pprof under /debug/pprof/,
+// e.g. for `go tool pprof http://localhost:6060/debug/pprof/profile`. They
+// are registered on a mux of their own rather than on http.DefaultServeMux
+// so that they are only reachable on PprofAddr.
+func PprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,76 @@
+// Package protocol holds what the server and its clients share of the text
+// protocol of kdtreed: the syntax of points and the responses that report a
+// failure.
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FormatPoint renders coordinates in the `{x, y, ...}` syntax of the
+// protocol, each with the shortest representation that parses back to the
+// exact same float64.
+func FormatPoint(coordinates []float64) string {
+	coords := make([]string, len(coordinates))
+	for i, x := range coordinates {
+		coords[i] = strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	return "{" + strings.Join(coords, ", ") + "}"
+}
+
+// StatusCodes maps the start of response lines to their status codes, after
+// the HTTP ones, as sent with the status_codes option of the server. Lines
+// starting with none of them, such as the records of a RANGE, are successes
+// with code 200.
+var StatusCodes = []struct {
+	prefix string
+	code   int
+}{
+	{"QUEUED", 202},
+	{"EMPTY", 204},
+	{"INVALID", 400},
+	{"TRAILING GARBAGE", 400},
+	{"READ ERROR", 400},
+	{"UNAUTHORIZED", 401},
+	{"READ ONLY", 403},
+	{"NOT FOUND", 404},
+	{"NO DATA FILE", 404},
+	{"NO SNAPSHOT DIR", 404},
+	{"TIMEOUT", 408},
+	{"DUPLICATE", 409},
+	{"DEDUPED", 409},
+	{"FAILED", 409},
+	{"NO BATCH", 409},
+	{"ALREADY IN BATCH", 409},
+	{"LINE TOO LONG", 413},
+	{"TOO LARGE", 413},
+	{"UNSUPPORTED FORMAT", 415},
+	{"DIMENSION MISMATCH", 422},
+	{"K TOO LARGE", 422},
+	{"NOT 2D", 422},
+	{"RATE LIMITED", 429},
+	{"ERROR", 500},
+	{"WAL FAILED", 500},
+	{"SAVE FAILED", 500},
+	{"LOAD FAILED", 500},
+	{"QUERY TIMEOUT", 503},
+	{"TOO MANY CONNECTIONS", 503},
+	{"SHUTTING DOWN", 503},
+}
+
+// StatusCode returns the status code of a response line.
+func StatusCode(line string) int {
+	for _, status := range StatusCodes {
+		if strings.HasPrefix(line, status.prefix) {
+			return status.code
+		}
+	}
+	return 200
+}
+
+// IsError reports whether a response line reports a failure, i.e. has a
+// status code of 400 or more.
+func IsError(line string) bool {
+	return StatusCode(line) >= 400
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter rate-limits commands per client IP with a token bucket for every
+// IP: a bucket holds up to rate tokens, a command takes one, and tokens are
+// refilled at rate per second. A nil Limiter allows everything.
+type Limiter struct {
+	sync.Mutex
+	rate float64
+	// delay is set when commands over the limit are to be delayed rather
+	// than refused.
+	delay   bool
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter allowing rate commands per second per client,
+// or everything if rate is 0, and delaying the commands over the limit if
+// delay is set. A nil Limiter allows everything too.
+func NewLimiter(rate int, delay bool) *Limiter {
+	limiter := &Limiter{buckets: make(map[string]*bucket)}
+	limiter.Configure(rate, delay)
+	return limiter
+}
+
+// Configure changes the limit, as when the config is reloaded. The buckets
+// are emptied, so every client starts afresh with a full one.
+func (limiter *Limiter) Configure(rate int, delay bool) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	limiter.rate = float64(rate)
+	limiter.delay = delay
+	limiter.buckets = make(map[string]*bucket)
+}
+
+// Delays reports whether the commands over the limit are to be delayed with
+// Delay rather than refused after Allow.
+func (limiter *Limiter) Delays() bool {
+	if limiter == nil {
+		return false
+	}
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.delay
+}
+
+// ClientKey returns the address commands of a connection are limited by: its
+// remote IP, so that clients cannot get around the limit by opening more
+// connections.
+func ClientKey(connection net.Conn) string {
+	addr := connection.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// take refills the bucket of key and takes a token from it, possibly going
+// into debt, and returns the bucket. The caller must hold the lock.
+func (limiter *Limiter) take(key string, now time.Time) *bucket {
+	b := limiter.buckets[key]
+	if b == nil {
+		// Forget the clients whose buckets are full again, so that the map
+		// does not grow with every IP ever seen.
+		if len(limiter.buckets) >= 1024 {
+			for k, other := range limiter.buckets {
+				if other.tokens+now.Sub(other.last).Seconds()*limiter.rate >= limiter.rate {
+					delete(limiter.buckets, k)
+				}
+			}
+		}
+		b = &bucket{tokens: limiter.rate, last: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+	if b.tokens > limiter.rate {
+		b.tokens = limiter.rate
+	}
+	b.last = now
+	b.tokens--
+	return b
+}
+
+// Allow reports whether key may run a command now, taking a token if so.
+func (limiter *Limiter) Allow(key string) bool {
+	if limiter == nil {
+		return true
+	}
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.rate <= 0 {
+		return true
+	}
+	b := limiter.take(key, time.Now())
+	if b.tokens < 0 {
+		b.tokens++
+		return false
+	}
+	return true
+}
+
+// Delay takes a token for key even if none is left and returns how long the
+// caller must wait before running the command for the token to be refilled.
+func (limiter *Limiter) Delay(key string) time.Duration {
+	if limiter == nil {
+		return 0
+	}
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.rate <= 0 {
+		return 0
+	}
+	b := limiter.take(key, time.Now())
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / limiter.rate * float64(time.Second))
+}
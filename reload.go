@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+)
+
+// Reloadable are the TOML keys of the settings a SIGHUP applies to the
+// running daemon. Any other setting, the address listened on first of all,
+// only changes on restart.
+var Reloadable = map[string]bool{"log_level": true, "read_timeout": true, "rate_limit": true, "rate_limit_delay": true,
+	"query_timeout": true, "slow_query_threshold": true}
+
+// readTimeout, queryTimeout and slowQueryThreshold are the ReadTimeout,
+// QueryTimeout and SlowQueryThreshold in effect, read atomically by
+// connections and stores as a reload may change them.
+var readTimeout, queryTimeout, slowQueryThreshold int64
+
+// ApplyTimeouts puts the timeouts and thresholds of config into effect.
+func ApplyTimeouts(config *ServerConfig) {
+	atomic.StoreInt64(&readTimeout, int64(config.ReadTimeout))
+	atomic.StoreInt64(&queryTimeout, int64(config.QueryTimeout))
+	atomic.StoreInt64(&slowQueryThreshold, int64(config.SlowQueryThreshold))
+}
+
+// Reload reads the config from fname again, as on startup, and applies the
+// Reloadable settings that changed since current to the daemon and to
+// current. Every changed setting is logged, along with whether it took
+// effect. A config that cannot be read or is invalid is ignored as a whole.
+func Reload(fname string, current *ServerConfig, limiter *Limiter) {
+	if fname == "-" {
+		logger.Warn("cannot reload config from standard input")
+		return
+	}
+	reloaded, err := LoadConfig(fname)
+	if err == nil {
+		err = reloaded.Validate()
+	}
+	if err != nil {
+		logger.Error("cannot reload config, keeping the current one", "file", fname, "error", err)
+		return
+	}
+	rate, delay := current.RateLimit, current.RateLimitDelay
+	before := reflect.ValueOf(current).Elem()
+	after := reflect.ValueOf(reloaded)
+	changed := 0
+	for i := 0; i < before.NumField(); i++ {
+		key := ConfigKey(before.Type().Field(i))
+		if reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			continue
+		}
+		if !Reloadable[key] {
+			// The values are left out as they may be secrets, such
+			// as the auth token.
+			logger.Warn("setting cannot change while running, restart to apply it", "setting", key)
+			continue
+		}
+		logger.Info("reloaded setting", "setting", key, "from", before.Field(i).Interface(), "to", after.Field(i).Interface())
+		before.Field(i).Set(after.Field(i))
+		changed++
+	}
+	level, _ := ParseLogLevel(current.LogLevel)
+	logger.SetLevel(level)
+	// Configuring the limiter empties its buckets, which would let every
+	// client burst again on each reload.
+	if current.RateLimit != rate || current.RateLimitDelay != delay {
+		limiter.Configure(current.RateLimit, current.RateLimitDelay)
+	}
+	ApplyTimeouts(current)
+	logger.Info("reloaded config", "file", fname, "changed", changed)
+}
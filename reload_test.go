@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// keepTimeouts restores the timeouts in effect when the test ends, for a
+// test that applies its own not to leak them into the next.
+func keepTimeouts(t *testing.T) {
+	read, query, slow := atomic.LoadInt64(&readTimeout), atomic.LoadInt64(&queryTimeout), atomic.LoadInt64(&slowQueryThreshold)
+	t.Cleanup(func() {
+		atomic.StoreInt64(&readTimeout, read)
+		atomic.StoreInt64(&queryTimeout, query)
+		atomic.StoreInt64(&slowQueryThreshold, slow)
+	})
+}
+
+func TestReload(t *testing.T) {
+	fname := t.TempDir() + "/kdtreed.toml"
+	if err := os.WriteFile(fname, []byte("port = \"8001\"\nrate_limit = 1\nquery_timeout = 5\nslow_query_threshold = 7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keepTimeouts(t)
+	current := DefaultConfig()
+	current.Port, current.RateLimit = "8001", 1
+	limiter := NewLimiter(current.RateLimit, current.RateLimitDelay)
+	if !limiter.Allow("client") || limiter.Allow("client") {
+		t.Fatal("the limiter does not allow a single command")
+	}
+	Reload(fname, &current, limiter)
+	if current.QueryTimeout != 5 || atomic.LoadInt64(&queryTimeout) != 5 {
+		t.Errorf("query_timeout is %d, in effect %d, want 5", current.QueryTimeout, atomic.LoadInt64(&queryTimeout))
+	}
+	if current.SlowQueryThreshold != 7 || atomic.LoadInt64(&slowQueryThreshold) != 7 {
+		t.Errorf("slow_query_threshold is %d, in effect %d, want 7", current.SlowQueryThreshold, atomic.LoadInt64(&slowQueryThreshold))
+	}
+	// The rate limit is unchanged, so the client must not get a fresh
+	// bucket.
+	if limiter.Allow("client") {
+		t.Error("reloading an unchanged rate limit refilled the buckets")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RestHandler serves the store operations over HTTP:
+//
+//	POST   /points                  body {"point":[1,2],"data":3}
+//	DELETE /points?point=1,2
+//	GET    /knn?point=1,2&k=5
+//	GET    /range?lower=0,0&upper=10,10
+//	GET    /ball?point=1,2&radius=1.5
+//	GET    /count
+//
+// Responses are JSONResponse bodies, as in the JSON mode of the TCP protocol.
+// When an AuthToken is configured every request must carry it in an
+// "Authorization: Bearer <token>" header.
+func RestHandler(store *KdtreeStore, config *ServerConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/points", func(w http.ResponseWriter, r *http.Request) {
+		if config.ReadOnly && (r.Method == http.MethodPost || r.Method == http.MethodDelete) {
+			WriteRestError(w, ErrReadOnly)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			// The body is bounded as a request line of the JSON mode is,
+			// and its point and payload as those of the TCP protocol.
+			body := r.Body
+			if config.MaxLineLength > 0 {
+				body = http.MaxBytesReader(w, r.Body, int64(config.MaxLineLength))
+			}
+			raw, err := io.ReadAll(body)
+			if err != nil {
+				WriteRestError(w, ErrTooLarge)
+				return
+			}
+			var request JSONRequest
+			if err := json.Unmarshal(raw, &request); err != nil || len(request.Point) == 0 {
+				WriteRest(w, http.StatusBadRequest, JSONError("INVALID POINT"))
+				return
+			}
+			if TooLarge(len(request.Point), MaxDimensions) || TooLarge(len(request.Data), MaxPayloadBytes) {
+				WriteRestError(w, ErrTooLarge)
+				return
+			}
+			data, ok := MakeJSONData(request.Data)
+			if !ok {
+				WriteRest(w, http.StatusBadRequest, JSONError("INVALID DATA"))
+				return
+			}
+			if err := store.Add(Scale(request.Point), data); err != nil {
+				WriteRestError(w, err)
+				return
+			}
+			WriteRest(w, http.StatusCreated, JSONResult(nil))
+		case http.MethodDelete:
+			point, ok := ParseRestPoint(r.URL.Query().Get("point"))
+			if !ok {
+				WriteRest(w, http.StatusBadRequest, JSONError("INVALID POINT"))
+				return
+			}
+			if TooLarge(len(point), MaxDimensions) {
+				WriteRestError(w, ErrTooLarge)
+				return
+			}
+			if err := store.Delete(point); err != nil {
+				WriteRestError(w, err)
+				return
+			}
+			WriteRest(w, http.StatusOK, JSONResult(nil))
+		default:
+			WriteRest(w, http.StatusMethodNotAllowed, JSONError("METHOD NOT ALLOWED"))
+		}
+	})
+	mux.HandleFunc("/knn", RestQuery(func(r *http.Request) (JSONResponse, error) {
+		point, ok := ParseRestPoint(r.URL.Query().Get("point"))
+		if !ok {
+			return JSONError("INVALID POINT"), nil
+		}
+		if TooLarge(len(point), MaxDimensions) {
+			return nil, ErrTooLarge
+		}
+		k, err := strconv.Atoi(r.URL.Query().Get("k"))
+		if err != nil || k <= 0 {
+			return JSONError("INVALID COUNT"), nil
+		}
+		rst, err := store.KNN(point, k, config.Metric())
+		return JSONResult(nil, "points", MakeJSONPoints(rst)), err
+	}))
+	mux.HandleFunc("/range", RestQuery(func(r *http.Request) (JSONResponse, error) {
+		lower, ok := ParseRestPoint(r.URL.Query().Get("lower"))
+		upper, ok2 := ParseRestPoint(r.URL.Query().Get("upper"))
+		if !ok || !ok2 {
+			return JSONError("INVALID POINT"), nil
+		}
+		if TooLarge(len(lower), MaxDimensions) || TooLarge(len(upper), MaxDimensions) {
+			return nil, ErrTooLarge
+		}
+		rst, err := store.Range(lower, upper)
+		return JSONResult(nil, "points", MakeJSONPoints(rst)), err
+	}))
+	mux.HandleFunc("/ball", RestQuery(func(r *http.Request) (JSONResponse, error) {
+		point, ok := ParseRestPoint(r.URL.Query().Get("point"))
+		if !ok {
+			return JSONError("INVALID POINT"), nil
+		}
+		if TooLarge(len(point), MaxDimensions) {
+			return nil, ErrTooLarge
+		}
+		radius, err := strconv.ParseFloat(r.URL.Query().Get("radius"), 64)
+		if err != nil || radius < 0 {
+			return JSONError("INVALID RADIUS"), nil
+		}
+		rst, err := store.Ball(point, ScaleDistance(radius), config.Metric())
+		return JSONResult(nil, "points", MakeJSONPoints(rst)), err
+	}))
+	mux.HandleFunc("/count", RestQuery(func(r *http.Request) (JSONResponse, error) {
+		count, _ := store.Stats()
+		return JSONResult(nil, "count", count), nil
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var session Session
+		if !session.Authenticate(config, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			WriteRest(w, http.StatusUnauthorized, JSONError("UNAUTHORIZED"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// RestQuery adapts a read-only query to a GET handler. Queries return an
+// error response for malformed parameters, and an error for parameters over
+// the limits of the protocol and for failed store operations.
+func RestQuery(query func(r *http.Request) (JSONResponse, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			WriteRest(w, http.StatusMethodNotAllowed, JSONError("METHOD NOT ALLOWED"))
+			return
+		}
+		response, err := query(r)
+		switch {
+		case err != nil:
+			WriteRestError(w, err)
+		case response["ok"] == false:
+			WriteRest(w, http.StatusBadRequest, response)
+		default:
+			WriteRest(w, http.StatusOK, response)
+		}
+	}
+}
+
+// ParseRestPoint parses comma-separated coordinates such as "1,2.5,-3".
+func ParseRestPoint(str string) ([]float64, bool) {
+	if str == "" {
+		return nil, false
+	}
+	coords := strings.Split(str, ",")
+	point := make([]float64, len(coords))
+	for i, coord := range coords {
+		var err error
+		if point[i], err = strconv.ParseFloat(strings.TrimSpace(coord), 64); err != nil {
+			return nil, false
+		}
+	}
+	return Scale(point), true
+}
+
+func WriteRest(w http.ResponseWriter, status int, response JSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// WriteRestError writes the response for an error returned by a store
+// operation.
+func WriteRestError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrDimensionMismatch), errors.Is(err, ErrKTooLarge):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrDeduped):
+		status = http.StatusConflict
+	case errors.Is(err, ErrQueryTimeout):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	}
+	WriteRest(w, status, JSONResult(err))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRestLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxLineLength = 1024
+	handler := RestHandler(&KdtreeStore{}, &config)
+	defer func(dimensions, payload int) { MaxDimensions, MaxPayloadBytes = dimensions, payload }(MaxDimensions, MaxPayloadBytes)
+	MaxDimensions, MaxPayloadBytes = 3, 8
+	cases := []struct {
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{"POST", "/points", `{"point":[1,2],"data":3}`, http.StatusCreated},
+		{"POST", "/points", `{"point":[1,2,3,4],"data":3}`, http.StatusRequestEntityTooLarge},
+		{"POST", "/points", `{"point":[1,2],"data":"a long payload"}`, http.StatusRequestEntityTooLarge},
+		{"POST", "/points", `{"point":[1,2],"data":"` + strings.Repeat("a", 2048) + `"}`, http.StatusRequestEntityTooLarge},
+		{"GET", "/knn?point=1,2&k=1", "", http.StatusOK},
+		{"GET", "/knn?point=1,2,3,4&k=1", "", http.StatusRequestEntityTooLarge},
+		{"GET", "/range?lower=0,0,0,0&upper=1,1,1,1", "", http.StatusRequestEntityTooLarge},
+		{"GET", "/ball?point=1,2,3,4&radius=1", "", http.StatusRequestEntityTooLarge},
+		{"DELETE", "/points?point=1,2,3,4", "", http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(c.method, c.target, strings.NewReader(c.body)))
+		if response.Code != c.want {
+			t.Errorf("%s %s: status %d, want %d: %s", c.method, c.target, response.Code, c.want, response.Body)
+		}
+	}
+}
+
+func TestRestStatus(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxK = 2
+	store := &KdtreeStore{maxK: config.MaxK}
+	handler := RestHandler(store, &config)
+	cases := []struct {
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{"POST", "/points", `{"point":[1,2],"data":3}`, http.StatusCreated},
+		{"POST", "/points", `{"point":[1,2,3],"data":3}`, http.StatusUnprocessableEntity},
+		{"POST", "/points", `{"point":[1,2],"data":{}}`, http.StatusBadRequest},
+		{"GET", "/knn?point=1,2&k=2", "", http.StatusOK},
+		{"GET", "/knn?point=1,2&k=3", "", http.StatusUnprocessableEntity},
+		{"GET", "/knn?point=1,2&k=0", "", http.StatusBadRequest},
+		{"GET", "/knn?point=1,2,3&k=1", "", http.StatusUnprocessableEntity},
+		{"GET", "/ball?point=1,2&radius=-1", "", http.StatusBadRequest},
+		{"DELETE", "/points?point=5,6", "", http.StatusNotFound},
+		{"PUT", "/points", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(c.method, c.target, strings.NewReader(c.body)))
+		if response.Code != c.want {
+			t.Errorf("%s %s: status %d, want %d: %s", c.method, c.target, response.Code, c.want, response.Body)
+		}
+	}
+}
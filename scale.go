@@ -0,0 +1,54 @@
+package main
+
+import "math"
+
+// CoordinateScale is the CoordinateScale of the config, 0 when coordinates
+// are stored as they are sent. Clients only ever see coordinates and
+// distances in their own units: Scale and ScaleDistance are applied to what
+// the parsers read, and Unscale and UnscaleDistance to what is written back,
+// the data file and write-ahead log included.
+var CoordinateScale float64
+
+// Scale returns the stored coordinates of point: each multiplied by
+// CoordinateScale and rounded to the nearest integer, halfway away from
+// zero.
+func Scale(point []float64) []float64 {
+	if CoordinateScale == 0 || point == nil {
+		return point
+	}
+	scaled := make([]float64, len(point))
+	for i, x := range point {
+		scaled[i] = math.Round(x * CoordinateScale)
+	}
+	return scaled
+}
+
+// Unscale returns the coordinates of a stored point in the units of clients.
+func Unscale(point []float64) []float64 {
+	if CoordinateScale == 0 || point == nil {
+		return point
+	}
+	unscaled := make([]float64, len(point))
+	for i, x := range point {
+		unscaled[i] = x / CoordinateScale
+	}
+	return unscaled
+}
+
+// ScaleDistance returns the distance between stored points of a distance in
+// the units of clients, such as a radius. Distances are not rounded.
+func ScaleDistance(distance float64) float64 {
+	if CoordinateScale == 0 {
+		return distance
+	}
+	return distance * CoordinateScale
+}
+
+// UnscaleDistance returns a distance between stored points in the units of
+// clients.
+func UnscaleDistance(distance float64) float64 {
+	if CoordinateScale == 0 {
+		return distance
+	}
+	return distance / CoordinateScale
+}
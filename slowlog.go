@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"github.com/etude-ist/kdtreed/protocol"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CountingConn counts the lines and bytes written to the connection, to
+// report the size of a response, and keeps its first line for its status.
+type CountingConn struct {
+	net.Conn
+	lines int
+	bytes int
+	first string
+	// code, when set, is the status of the response instead of that of
+	// its first line.
+	code int
+}
+
+func (conn *CountingConn) Write(p []byte) (int, error) {
+	if conn.lines == 0 {
+		conn.first += string(p)
+	}
+	conn.lines += bytes.Count(p, []byte("\n"))
+	conn.bytes += len(p)
+	return conn.Conn.Write(p)
+}
+
+// Observe records the time a command started at start took in the metrics of
+// the store, and logs the command at warn level if it took longer than the
+// SlowQueryThreshold, along with the size of the response written to
+// response. The command is recorded in the access log too, with its point.
+func Observe(store *KdtreeStore, response *CountingConn, action string, command string, point []float64, start time.Time) {
+	accessLog.Record(response, action, point)
+	elapsed := time.Since(start)
+	store.metrics.Observe(action, elapsed)
+	threshold := time.Duration(atomic.LoadInt64(&slowQueryThreshold)) * time.Millisecond
+	if threshold > 0 && elapsed > threshold {
+		logger.Warn("slow command", "remote", response.RemoteAddr(), "command", strings.TrimSpace(command),
+			"duration", elapsed, "lines", response.lines, "bytes", response.bytes)
+	}
+}
+
+// Code returns the status code of the response written to the connection,
+// that of its first line unless set by the command, as JSON responses are.
+func (conn *CountingConn) Code() int {
+	if conn.code != 0 {
+		return conn.code
+	}
+	return protocol.StatusCode(strings.TrimSpace(conn.first))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/etude-ist/kdtreed/protocol"
+	"net"
+	"strconv"
+)
+
+// StatusConn prefixes every line written to the connection with its status
+// code, e.g. `404 NOT FOUND`.
+type StatusConn struct {
+	net.Conn
+	// line holds the start of a line whose end is yet to be written.
+	line []byte
+}
+
+func (conn *StatusConn) Write(p []byte) (int, error) {
+	var coded []byte
+	for _, b := range p {
+		conn.line = append(conn.line, b)
+		if b == '\n' {
+			coded = append(coded, strconv.Itoa(protocol.StatusCode(string(conn.line)))+" "...)
+			coded = append(coded, conn.line...)
+			conn.line = conn.line[:0]
+		}
+	}
+	if _, err := conn.Conn.Write(coded); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// TextConn returns the connection to write text protocol responses to: a
+// StatusConn when the status_codes option is set, the connection itself
+// otherwise.
+func TextConn(connection net.Conn, config *ServerConfig) net.Conn {
+	if config.StatusCodes {
+		return &StatusConn{Conn: connection}
+	}
+	return connection
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/etude-ist/kdtreed/kdstore"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned by the store operations. ErrorResponse maps them to the
+// responses of the text protocol.
+var (
+	ErrDimensionMismatch = kdstore.ErrDimensionMismatch
+	ErrNotFound          = kdstore.ErrNotFound
+	ErrWalFailed         = errors.New("cannot append to write-ahead log")
+	ErrKTooLarge         = errors.New("k exceeds the configured maximum")
+	ErrDuplicate         = errors.New("point already exists")
+	ErrTooLarge          = errors.New("point or payload exceeds the configured maximum")
+	ErrDeduped           = errors.New("point added within the dedup window")
+	// ErrQueryTimeout is the context error of a query aborted for running
+	// past the QueryTimeout.
+	ErrQueryTimeout = context.DeadlineExceeded
+	// ErrReadOnly is returned by the store once drained; a read-only server
+	// rejects mutations before they reach it.
+	ErrReadOnly = errors.New("read only")
+	// ErrInvalidPath and ErrNoSnapshotDir refuse the paths of SAVE and
+	// LOAD, see SnapshotPath.
+	ErrInvalidPath   = errors.New("path leaves the snapshot directory")
+	ErrNoSnapshotDir = errors.New("no snapshot directory configured")
+)
+
+var errorResponses = map[error]string{
+	ErrDimensionMismatch: "DIMENSION MISMATCH",
+	ErrNotFound:          "NOT FOUND",
+	ErrWalFailed:         "WAL FAILED",
+	ErrReadOnly:          "READ ONLY",
+	ErrKTooLarge:         "K TOO LARGE",
+	ErrDuplicate:         "DUPLICATE",
+	ErrTooLarge:          "TOO LARGE",
+	ErrDeduped:           "DEDUPED",
+	ErrQueryTimeout:      "QUERY TIMEOUT",
+	ErrInvalidGeoJSON:    "INVALID GEOJSON",
+	ErrInvalidPath:       "INVALID PATH",
+	ErrNoSnapshotDir:     "NO SNAPSHOT DIR",
+}
+
+// ErrorResponse returns the protocol response for an error returned by a
+// store operation.
+func ErrorResponse(err error) string {
+	for target, response := range errorResponses {
+		if errors.Is(err, target) {
+			return response
+		}
+	}
+	return "ERROR"
+}
+
+// KdtreeStore is the store served by the daemon: a kdstore.Store whose
+// mutations are logged to the write-ahead log and timed in the metrics. Its
+// methods take the place of the promoted ones of the same names.
+//
+// Readers get the guarantee of kdstore.Store for each command: a KNN, RANGE
+// or BALL never observes a DEL or any other mutation half applied. The
+// mutations made of several changes, i.e. BULK, DELRANGE, LOAD and batches,
+// are applied under a single write lock and so are observed all at once too.
+// Nothing holds across commands, though: two queries of a connection may see
+// different states of the store.
+type KdtreeStore struct {
+	// commands counts the commands served since boot. It is updated
+	// atomically rather than under the lock, and kept first for 64-bit
+	// alignment.
+	commands uint64
+	kdstore.Store
+	wal     *Wal
+	metrics *Metrics
+	// maxK bounds the k of KNN queries; 0 means no bound.
+	maxK int
+	// duplicates is the DuplicatePolicy. Only replace and reject take
+	// effect; anything else allows duplicates.
+	duplicates string
+	// dedup drops the ADDs of points added within the DedupWindow.
+	dedup *Dedup
+	// drained is set by Drain, under the write lock, after which every
+	// mutation fails with ErrReadOnly.
+	drained bool
+}
+
+// Mutate applies an ADD, UPDATE, DEL or CLEAR to the store and returns the
+// command to log for it. Points are matched as by Find, and the logged
+// command carries the exact coordinates of the matched point. An ADD of a
+// point matching a stored one follows the duplicate policy. The caller must
+// hold the store lock.
+func (store *KdtreeStore) Mutate(action string, point []float64, data Data) (string, error) {
+	if store.drained {
+		return "", ErrReadOnly
+	}
+	if action == "CLEAR" {
+		store.Reset([]kdtree.Point{})
+		return "CLEAR", nil
+	}
+	if err := store.CheckDimension(point); err != nil {
+		return "", err
+	}
+	if action == "ADD" {
+		if data.added.IsZero() {
+			data.added = time.Now()
+		}
+		exists := (store.duplicates == "replace" || store.duplicates == "reject") && store.Find(point) != nil
+		if !exists {
+			store.Insert(point, data)
+			return "ADD " + FormatStamped(points.NewPoint(point, data)), nil
+		}
+		if store.duplicates == "reject" {
+			return "", ErrDuplicate
+		}
+		// Under the replace policy an ADD of a stored point updates it.
+		action = "UPDATE"
+	}
+	found := store.Lookup(point)
+	if found == nil || !store.RemoveExact(found.(*points.Point).Coordinates) {
+		return "", ErrNotFound
+	}
+	removed := found.(*points.Point)
+	if action == "DEL" {
+		return "DEL " + FormatPoint(removed.Coordinates), nil
+	}
+	// The point keeps the time it was first added.
+	data.added = removed.Data.(Data).added
+	store.Insert(removed.Coordinates, data)
+	return "UPDATE " + FormatStamped(points.NewPoint(removed.Coordinates, data)), nil
+}
+
+// mutate applies a single mutation under the write lock and logs it. An ADD
+// of coordinates added within the dedup window fails with ErrDeduped; the
+// ADDs of batches are not deduplicated.
+func (store *KdtreeStore) mutate(action string, point []float64, data Data) error {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	if action == "ADD" && store.dedup.Seen(point, now) {
+		return ErrDeduped
+	}
+	command, err := store.Mutate(action, point, data)
+	if err != nil {
+		return err
+	}
+	if action == "ADD" {
+		store.dedup.Add(point, now)
+	}
+	return store.Log(command)
+}
+
+// Add inserts a point with its payload and logs the insertion.
+func (store *KdtreeStore) Add(point []float64, data Data) error {
+	return store.mutate("ADD", point, data)
+}
+
+// Bulk adds pts to the store at once. Rather than inserting them one by one,
+// the tree is rebuilt balanced from the stored and the new points and then
+// swapped in, which is both faster to build and faster to query. Either all
+// of the points are added or, on a dimension mismatch or a duplicate the
+// policy rejects, none of them. The duplicate policy applies to the points
+// matching stored ones, not to the points of a single BULK matching each
+// other.
+func (store *KdtreeStore) Bulk(pts []kdtree.Point) error {
+	store.Lock()
+	defer store.Unlock()
+	if store.drained {
+		return ErrReadOnly
+	}
+	coordinates := make([][]float64, len(pts))
+	commands := make([]string, len(pts))
+	now := time.Now()
+	for i, p := range pts {
+		point := p.(*points.Point)
+		if data := point.Data.(Data); data.added.IsZero() {
+			data.added = now
+			point.Data = data
+		}
+		coordinates[i] = point.Coordinates
+		commands[i] = "ADD " + FormatStamped(p)
+	}
+	if err := store.CheckDimension(coordinates...); err != nil {
+		return err
+	}
+	if len(pts) == 0 {
+		return nil
+	}
+	removals := []string{}
+	switch store.duplicates {
+	case "reject":
+		for _, point := range coordinates {
+			if store.Find(point) != nil {
+				return ErrDuplicate
+			}
+		}
+	case "replace":
+		for _, point := range coordinates {
+			if removed := store.Remove(point); removed != nil {
+				removals = append(removals, "DEL "+FormatPoint(removed))
+			}
+		}
+	}
+	store.Reset(append(store.Gather(store.Count()+len(pts)), pts...))
+	return store.Log(strings.Join(append(removals, commands...), "\n"))
+}
+
+// Swap replaces every point of the store with pts at once, so that readers
+// see either the old or the new points and never an empty store in between.
+// The new tree is built balanced aside before the write lock is taken, and
+// the write-ahead log records the swap as a CLEAR followed by the new
+// points, as for LOAD. The new points must agree with each other but not
+// with the old ones; the duplicate policy does not apply to them.
+func (store *KdtreeStore) Swap(pts []kdtree.Point) error {
+	var side kdstore.Store
+	coordinates := make([][]float64, len(pts))
+	commands := make([]string, len(pts)+1)
+	commands[0] = "CLEAR"
+	now := time.Now()
+	for i, p := range pts {
+		point := p.(*points.Point)
+		if data := point.Data.(Data); data.added.IsZero() {
+			data.added = now
+			point.Data = data
+		}
+		coordinates[i] = point.Coordinates
+		commands[i+1] = "ADD " + FormatStamped(p)
+	}
+	if err := side.CheckDimension(coordinates...); err != nil {
+		return err
+	}
+	side.Reset(pts)
+	store.Lock()
+	defer store.Unlock()
+	if store.drained {
+		return ErrReadOnly
+	}
+	store.Store.Swap(&side)
+	return store.Log(strings.Join(commands, "\n"))
+}
+
+// Delete removes the point matching the given coordinates and logs the
+// removal of its exact coordinates.
+func (store *KdtreeStore) Delete(point []float64) error {
+	return store.mutate("DEL", point, Data{})
+}
+
+// DeleteRange removes every point inside the box spanned by two opposite
+// corners under a single write lock, logs the removals and returns how many
+// points were removed. The points are collected first and then removed one
+// by one, as the tree cannot be modified while it is searched.
+func (store *KdtreeStore) DeleteRange(lower []float64, upper []float64) (int, error) {
+	store.Lock()
+	defer store.Unlock()
+	if store.drained {
+		return 0, ErrReadOnly
+	}
+	if err := store.CheckDimension(lower, upper); err != nil {
+		return 0, err
+	}
+	commands := []string{}
+	for _, p := range store.Search(lower, upper) {
+		coordinates := p.(*points.Point).Coordinates
+		if store.RemoveExact(coordinates) {
+			commands = append(commands, "DEL "+FormatPoint(coordinates))
+		}
+	}
+	if len(commands) == 0 {
+		return 0, nil
+	}
+	return len(commands), store.Log(strings.Join(commands, "\n"))
+}
+
+// Update replaces the payload of the point matching the given coordinates
+// and logs the update. The point is removed and re-inserted with its new
+// payload under a single write lock, so no reader ever sees the point
+// missing or the old and new payloads at once.
+func (store *KdtreeStore) Update(point []float64, data Data) error {
+	return store.mutate("UPDATE", point, data)
+}
+
+// Clear removes every point. The dimension is forgotten along with the
+// points, so the next Add may start a tree of a different dimension.
+func (store *KdtreeStore) Clear() error {
+	return store.mutate("CLEAR", nil, Data{})
+}
+
+// Commit applies a batch of ADD, UPDATE, DEL and CLEAR commands under a
+// single write lock, so readers see either none or all of them, and logs
+// them together. If a command fails the store is restored to its state
+// before the batch, and the index of the command is returned with its
+// error. Restoring requires keeping the points from before the batch, so
+// every commit costs a pass over the whole tree.
+func (store *KdtreeStore) Commit(batch []Expr) (int, error) {
+	store.Lock()
+	defer store.Unlock()
+	before := store.Points()
+	commands := make([]string, len(batch))
+	for i, expr := range batch {
+		command, err := store.Mutate(expr.action, expr.point, expr.data)
+		if err != nil {
+			store.Reset(before)
+			return i, err
+		}
+		commands[i] = command
+	}
+	if len(commands) == 0 {
+		return 0, nil
+	}
+	return len(batch), store.Log(strings.Join(commands, "\n"))
+}
+
+// Drain makes the store read-only. Mutations under way when it is called
+// complete first, as it waits for the write lock; every later one fails with
+// ErrReadOnly, so a snapshot saved afterwards holds the final points.
+func (store *KdtreeStore) Drain() {
+	store.Lock()
+	defer store.Unlock()
+	store.drained = true
+}
+
+// Rebalance rebuilds the tree from its points, which undoes the degradation
+// left by many ADDs and DELs, and returns the number of points.
+func (store *KdtreeStore) Rebalance() int {
+	store.Lock()
+	defer store.Unlock()
+	if store.Count() > 0 {
+		store.Reset(store.Gather(store.Count()))
+	}
+	return store.Count()
+}
+
+// Get returns the point matching the given coordinates, as found by Lookup.
+func (store *KdtreeStore) Get(point []float64) (kdtree.Point, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(point); err != nil {
+		return nil, err
+	}
+	found := store.Lookup(point)
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// queryContext returns the context the traversals of a query run under,
+// done once the QueryTimeout in effect has passed, and its cancel function.
+// A query aborted this way fails with ErrQueryTimeout.
+func (store *KdtreeStore) queryContext() (context.Context, context.CancelFunc) {
+	timeout := atomic.LoadInt64(&queryTimeout)
+	if timeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+}
+
+// KNN returns up to k points nearest to point under the named metric,
+// nearest first.
+func (store *KdtreeStore) KNN(point []float64, k int, metric string) ([]kdtree.Point, error) {
+	return store.ApproximateKNN(point, k, metric, 0)
+}
+
+// ApproximateKNN is KNN with the error bound eps of MetricKNN.
+func (store *KdtreeStore) ApproximateKNN(point []float64, k int, metric string, eps float64) ([]kdtree.Point, error) {
+	if store.maxK > 0 && k > store.maxK {
+		return nil, ErrKTooLarge
+	}
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(point); err != nil {
+		return nil, err
+	}
+	ctx, cancel := store.queryContext()
+	defer cancel()
+	return store.MetricKNN(ctx, point, k, metric, eps)
+}
+
+// MultiKNN returns up to k points nearest to each of queries under the named
+// metric, nearest first, in the order of queries. All of them are answered
+// under a single read lock, each query within its own query timeout, and
+// none is if one of them has the wrong dimension.
+func (store *KdtreeStore) MultiKNN(queries [][]float64, k int, metric string) ([][]kdtree.Point, error) {
+	if store.maxK > 0 && k > store.maxK {
+		return nil, ErrKTooLarge
+	}
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(queries...); err != nil {
+		return nil, err
+	}
+	rst := make([][]kdtree.Point, len(queries))
+	for i, point := range queries {
+		ctx, cancel := store.queryContext()
+		neighbours, err := store.MetricKNN(ctx, point, k, metric, 0)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		rst[i] = neighbours
+	}
+	return rst, nil
+}
+
+// KDist returns the distance from point to its k-th nearest neighbour under
+// the named metric, in the units of clients, and false if the store holds
+// fewer than k points.
+func (store *KdtreeStore) KDist(point []float64, k int, metric string) (float64, bool, error) {
+	rst, err := store.KNN(point, k, metric)
+	if err != nil || len(rst) < k {
+		return 0, false, err
+	}
+	return UnscaleDistance(DistanceMetrics[metric](point, rst[k-1].(*points.Point).Coordinates)), true, nil
+}
+
+// FilteredKNN returns up to k points nearest to point under the named
+// metric, within the error bound eps, whose payloads match filter, nearest
+// first. The tree cannot filter
+// while it searches, so ever more neighbours are fetched, doubling their
+// number each time, until k of them match or the tree is exhausted. When few
+// points match this degrades to ranking the whole tree, under a read lock,
+// as many as log2(n/k) times over.
+func (store *KdtreeStore) FilteredKNN(point []float64, k int, metric string, eps float64, filter Filter) ([]kdtree.Point, error) {
+	if filter == (Filter{}) || store.maxK > 0 && k > store.maxK {
+		return store.ApproximateKNN(point, k, metric, eps)
+	}
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(point); err != nil {
+		return nil, err
+	}
+	// The timeout bounds all the rounds together.
+	ctx, cancel := store.queryContext()
+	defer cancel()
+	rst := []kdtree.Point{}
+	for n := k; ; n *= 2 {
+		candidates, err := store.MetricKNN(ctx, point, n, metric, eps)
+		if err != nil {
+			return nil, err
+		}
+		rst = rst[:0]
+		for _, p := range candidates {
+			if filter.Matches(p.(*points.Point).Data.(Data)) {
+				rst = append(rst, p)
+			}
+			if len(rst) == k {
+				return rst, nil
+			}
+		}
+		if len(candidates) < n || n >= store.Count() {
+			return rst, nil
+		}
+	}
+}
+
+// Range returns the points inside the box spanned by two opposite corners.
+func (store *KdtreeStore) Range(lower []float64, upper []float64) ([]kdtree.Point, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(lower, upper); err != nil {
+		return nil, err
+	}
+	ctx, cancel := store.queryContext()
+	defer cancel()
+	return store.SearchContext(ctx, lower, upper)
+}
+
+// StreamRange calls fn for every point inside the box spanned by two
+// opposite corners that matches filter, as the tree is traversed, and stops
+// early when fn returns false. Memory use does not grow with the number of
+// points, but the read lock is held until the walk is over, so a consumer
+// slow to take the points holds up writers for as long: fn must not block
+// without bound.
+func (store *KdtreeStore) StreamRange(lower []float64, upper []float64, filter Filter, fn func(kdtree.Point) bool) error {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(lower, upper); err != nil {
+		return err
+	}
+	ctx, cancel := store.queryContext()
+	defer cancel()
+	return store.WalkContext(ctx, lower, upper, func(p kdtree.Point) bool {
+		return !filter.Matches(p.(*points.Point).Data.(Data)) || fn(p)
+	})
+}
+
+// Ball returns the points within radius of point under the named metric.
+func (store *KdtreeStore) Ball(point []float64, radius float64, metric string) ([]kdtree.Point, error) {
+	// Only points inside the bounding box of the ball can be within the
+	// radius under any of the metrics, so let the tree prune the rest.
+	lower := make([]float64, len(point))
+	upper := make([]float64, len(point))
+	for i, x := range point {
+		lower[i], upper[i] = x-radius, x+radius
+	}
+	candidates, err := store.Range(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	rst := []kdtree.Point{}
+	for _, p := range candidates {
+		if DistanceMetrics[metric](point, p.(*points.Point).Coordinates) <= radius {
+			rst = append(rst, p)
+		}
+	}
+	return rst, nil
+}
+
+// CountBall returns the number of points within radius of point under the
+// named metric, as Ball would return them, counting them as the tree is
+// traversed rather than collecting them.
+func (store *KdtreeStore) CountBall(point []float64, radius float64, metric string) (int, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(point); err != nil {
+		return 0, err
+	}
+	lower := make([]float64, len(point))
+	upper := make([]float64, len(point))
+	for i, x := range point {
+		lower[i], upper[i] = x-radius, x+radius
+	}
+	ctx, cancel := store.queryContext()
+	defer cancel()
+	count := 0
+	distance := DistanceMetrics[metric]
+	err := store.WalkContext(ctx, lower, upper, func(p kdtree.Point) bool {
+		if distance(point, p.(*points.Point).Coordinates) <= radius {
+			count++
+		}
+		return true
+	})
+	return count, err
+}
+
+// Centroid returns the mean of the points inside the box spanned by two
+// opposite corners and their number, summing their coordinates over a walk
+// of the box rather than gathering them.
+func (store *KdtreeStore) Centroid(lower []float64, upper []float64) ([]float64, int, error) {
+	store.RLock()
+	defer store.RUnlock()
+	if err := store.CheckDimension(lower, upper); err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := store.queryContext()
+	defer cancel()
+	sums := make([]float64, len(lower))
+	count := 0
+	err := store.WalkContext(ctx, lower, upper, func(p kdtree.Point) bool {
+		for i, x := range p.(*points.Point).Coordinates {
+			sums[i] += x
+		}
+		count++
+		return true
+	})
+	if err != nil || count == 0 {
+		return nil, 0, err
+	}
+	for i := range sums {
+		sums[i] /= float64(count)
+	}
+	return sums, count, nil
+}
+
+// Bounds returns the lower and upper corners of the bounding box of the
+// stored points, and false if there are none.
+func (store *KdtreeStore) Bounds() ([]float64, []float64, bool) {
+	store.RLock()
+	defer store.RUnlock()
+	lower, upper := store.Store.Bounds()
+	return lower, upper, lower != nil
+}
+
+// Dump returns every stored point. The slice is taken under a read lock, so
+// it can be written out without holding up writers.
+func (store *KdtreeStore) Dump() []kdtree.Point {
+	store.RLock()
+	defer store.RUnlock()
+	return store.Points()
+}
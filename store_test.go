@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/etude-ist/kdtreed/kdstore"
+	"github.com/kyroy/kdtree"
+	"github.com/kyroy/kdtree/points"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// degenerate returns a store of n points on a diagonal, added in order, so
+// that every point goes down the right of the one before and the tree is a
+// list.
+func degenerate(n int) *KdtreeStore {
+	store := &KdtreeStore{}
+	for i := 0; i < n; i++ {
+		store.Add([]float64{float64(i), float64(i)}, Data{value: i})
+	}
+	return store
+}
+
+func benchmarkKNN(b *testing.B, store *KdtreeStore) {
+	count, _ := store.Stats()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x := float64(i % count)
+		store.KNN([]float64{x, x}, 10, "EUCLIDEAN")
+	}
+}
+
+func BenchmarkKNNDegenerate(b *testing.B) {
+	benchmarkKNN(b, degenerate(5000))
+}
+
+func BenchmarkKNNRebalanced(b *testing.B) {
+	store := degenerate(5000)
+	store.Rebalance()
+	benchmarkKNN(b, store)
+}
+
+// sizes are the numbers of points of the trees the store benchmarks run
+// against.
+var sizes = []struct {
+	name string
+	n    int
+}{{"1k", 1000}, {"100k", 100000}, {"1M", 1000000}}
+
+// random returns a balanced store of n points drawn uniformly from the unit
+// square, and a source of query points drawn the same way.
+func random(b *testing.B, n int) (*KdtreeStore, *rand.Rand) {
+	b.Helper()
+	source := rand.New(rand.NewSource(1))
+	pts := make([]kdtree.Point, n)
+	for i := range pts {
+		pts[i] = points.NewPoint([]float64{source.Float64(), source.Float64()}, Data{value: i})
+	}
+	store := &KdtreeStore{}
+	if err := store.Bulk(pts); err != nil {
+		b.Fatal(err)
+	}
+	return store, source
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(size.name, func(b *testing.B) {
+			store, source := random(b, size.n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.Add([]float64{source.Float64(), source.Float64()}, Data{value: i})
+			}
+		})
+	}
+}
+
+func BenchmarkKNN(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(size.name, func(b *testing.B) {
+			store, source := random(b, size.n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.KNN([]float64{source.Float64(), source.Float64()}, 10, "EUCLIDEAN")
+			}
+		})
+	}
+}
+
+func BenchmarkRange(b *testing.B) {
+	for _, size := range sizes {
+		b.Run(size.name, func(b *testing.B) {
+			store, source := random(b, size.n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				x, y := source.Float64(), source.Float64()
+				store.Range([]float64{x, y}, []float64{x + 0.01, y + 0.01})
+			}
+		})
+	}
+}
+
+// BenchmarkApproximateKNN compares the exact search of the tree, the same
+// search by reflection, as with a query timeout, and searches pruned with an
+// error bound.
+func BenchmarkApproximateKNN(b *testing.B) {
+	store, source := random(b, 100000)
+	b.Run("exact", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			store.ApproximateKNN([]float64{source.Float64(), source.Float64()}, 10, "EUCLIDEAN", 0)
+		}
+	})
+	for _, eps := range []float64{0, 0.5, 2} {
+		b.Run(fmt.Sprintf("eps=%v", eps), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				store.ApproximateNearestContext(context.Background(), []float64{source.Float64(), source.Float64()}, 10, eps)
+			}
+		})
+	}
+}
+
+// TestApproximateKNN checks the error bound of approximate Euclidean
+// queries against the exact ones.
+func TestApproximateKNN(t *testing.T) {
+	source := rand.New(rand.NewSource(1))
+	store := &KdtreeStore{}
+	for i := 0; i < 5000; i++ {
+		store.Add([]float64{source.Float64(), source.Float64()}, Data{value: i})
+	}
+	for _, eps := range []float64{0, 0.5, 2} {
+		for i := 0; i < 200; i++ {
+			query := []float64{source.Float64(), source.Float64()}
+			exact, err := store.KNN(query, 10, "EUCLIDEAN")
+			if err != nil {
+				t.Fatal(err)
+			}
+			approximate, err := store.ApproximateNearestContext(context.Background(), query, 10, eps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(approximate) != len(exact) {
+				t.Fatalf("eps %v: %d points, want %d", eps, len(approximate), len(exact))
+			}
+			want := kdstore.Distance(query, coordinatesOf(exact[len(exact)-1]))
+			if got := kdstore.Distance(query, coordinatesOf(approximate[len(approximate)-1])); got > (1+eps)*want {
+				t.Fatalf("eps %v: k-th distance %v, want at most %v", eps, got, (1+eps)*want)
+			}
+		}
+	}
+}
+
+// TestConcurrentMutationsAndQueries interleaves thousands of ADDs and DELs
+// with KNN and RANGE queries, for the race detector to check that readers
+// never see a mutation half applied. Every point carries its coordinates as
+// its payload, so that a query returning a corrupted point is caught too.
+func TestConcurrentMutationsAndQueries(t *testing.T) {
+	store := &KdtreeStore{}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			source := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 2000; i++ {
+				x, y := float64(source.Intn(50)), float64(source.Intn(50))
+				query := []float64{x, y}
+				switch w % 4 {
+				case 0:
+					store.Add(query, Data{value: int(x*100 + y)})
+				case 1:
+					store.Delete(query)
+				case 2:
+					rst, err := store.KNN(query, 5, "EUCLIDEAN")
+					if err == nil {
+						err = checkPoints(rst)
+					}
+					for j := 1; err == nil && j < len(rst); j++ {
+						if kdstore.Distance(query, coordinatesOf(rst[j])) < kdstore.Distance(query, coordinatesOf(rst[j-1])) {
+							err = fmt.Errorf("KNN %v: %v before %v", query, rst[j-1], rst[j])
+						}
+					}
+					if err == nil && len(rst) > 5 {
+						err = fmt.Errorf("KNN %v: %d results for k=5", query, len(rst))
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				case 3:
+					upper := []float64{x + 10, y + 10}
+					rst, err := store.Range(query, upper)
+					if err == nil {
+						err = checkPoints(rst)
+					}
+					for _, p := range rst {
+						c := coordinatesOf(p)
+						if err == nil && (c[0] < x || c[0] > upper[0] || c[1] < y || c[1] > upper[1]) {
+							err = fmt.Errorf("RANGE %v %v: %v outside", query, upper, c)
+						}
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func coordinatesOf(p kdtree.Point) []float64 {
+	return p.(*points.Point).Coordinates
+}
+
+// checkPoints checks that the payload of every point matches its
+// coordinates, as added by TestConcurrentMutationsAndQueries.
+func checkPoints(pts []kdtree.Point) error {
+	for _, p := range pts {
+		c := coordinatesOf(p)
+		if data := p.(*points.Point).Data.(Data); data.value != int(c[0]*100+c[1]) {
+			return fmt.Errorf("%v carries %v", c, data)
+		}
+	}
+	return nil
+}
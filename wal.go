@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kyroy/kdtree"
+	"io"
+	"os"
+)
+
+// Wal is an append-only log of the mutations applied to a store since its
+// last snapshot. Every line is a protocol command, so replaying the log is a
+// matter of parsing and applying the commands in order.
+type Wal struct {
+	file *os.File
+}
+
+// OpenWal opens fname for appending, creating it if needed.
+func OpenWal(fname string) (*Wal, error) {
+	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Wal{file: file}, nil
+}
+
+// Append writes command to the log and syncs it to disk.
+func (wal *Wal) Append(command string) error {
+	if _, err := wal.file.WriteString(command + "\n"); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// Truncate empties the log once its commands are covered by a snapshot.
+func (wal *Wal) Truncate() error {
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// Log appends a mutation to the write-ahead log, if the store has one. The
+// caller must hold the store lock so that the log order matches the order in
+// which mutations were applied. Failures are logged and reported as
+// ErrWalFailed: the mutation has been applied but is not durable.
+func (store *KdtreeStore) Log(command string) error {
+	if store.wal == nil {
+		return nil
+	}
+	if err := store.wal.Append(command); err != nil {
+		logger.Error("cannot append to write-ahead log", "command", command, "error", err)
+		return ErrWalFailed
+	}
+	return nil
+}
+
+// Replay applies the commands logged in fname to the store and returns how
+// many were applied. A missing log is not an error. An unterminated last line
+// is the remnant of a write that was interrupted before it was acknowledged,
+// so it is skipped.
+func Replay(store *KdtreeStore, fname string) (int, error) {
+	file, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	store.Lock()
+	defer store.Unlock()
+	reader := bufio.NewReader(file)
+	applied := 0
+	for line := 1; ; line++ {
+		command, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if command != "" {
+				logger.Warn("skipping incomplete write-ahead log record", "file", fname, "line", line)
+			}
+			return applied, nil
+		}
+		if err != nil {
+			return applied, err
+		}
+
+		expr := ParseKDtreeCommand(command)
+		if expr.comment {
+			continue
+		}
+		if !expr.valid {
+			return applied, fmt.Errorf("%s:%d: invalid record", fname, line)
+		}
+		switch expr.action {
+		case "ADD":
+			if store.CheckDimension(expr.point) != nil {
+				return applied, fmt.Errorf("%s:%d: dimension mismatch", fname, line)
+			}
+			store.Insert(expr.point, expr.data)
+		case "DEL":
+			store.Remove(expr.point)
+		case "UPDATE":
+			if removed := store.Remove(expr.point); removed != nil {
+				store.Insert(removed, expr.data)
+			}
+		case "CLEAR":
+			store.Reset([]kdtree.Point{})
+		default:
+			return applied, fmt.Errorf("%s:%d: unexpected %s record", fname, line, expr.action)
+		}
+		applied++
+	}
+}